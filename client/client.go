@@ -0,0 +1,216 @@
+// Package client uploads files to a webshare server and downloads them,
+// encrypting and decrypting them end-to-end if asked to.
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client talks to the webshare server at URL.
+type Client struct {
+	URL string
+	// Token is the API token uploads are authenticated with, servers may
+	// refuse anonymous uploads
+	Token      string
+	HTTPClient *http.Client
+}
+
+// New returns a client of the server at serverURL.
+func New(serverURL string) *Client {
+	return &Client{URL: strings.TrimSuffix(serverURL, "/"), HTTPClient: http.DefaultClient}
+}
+
+// UploadOptions are the choices of the uploader, the zero value uploads the
+// file as it is and keeps it as long as the server allows.
+type UploadOptions struct {
+	// Encrypt encrypts the file end-to-end, the key is only put into the
+	// link of the share
+	Encrypt bool
+	// ContentType of the file, shown by the browser after decrypting it
+	ContentType  string
+	Password     string
+	MaxDownloads int
+	// Expires is a duration like "1h" or "7d", or an RFC 3339 time
+	Expires string
+}
+
+// Upload is a stored file.
+type Upload struct {
+	ID string `json:"id"`
+	// Link is the share page, with the key in the fragment for encrypted
+	// files
+	Link        string    `json:"-"`
+	DeleteToken string    `json:"delete_token"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	// SHA256 of the data as stored, which is the encrypted data for
+	// encrypted files
+	SHA256 string `json:"sha256"`
+}
+
+// Upload uploads everything read from r as a file called name.
+func (c *Client) Upload(name string, r io.Reader, opts UploadOptions) (*Upload, error) {
+	fields := map[string]string{
+		"password": opts.Password,
+		"expires":  opts.Expires,
+	}
+	if opts.MaxDownloads > 0 {
+		fields["max_downloads"] = strconv.Itoa(opts.MaxDownloads)
+	}
+	var key []byte
+	if opts.Encrypt {
+		var err error
+		if key, err = NewKey(); err != nil {
+			return nil, err
+		}
+		meta, err := SealMeta(key, Meta{Name: name, Type: opts.ContentType})
+		if err != nil {
+			return nil, err
+		}
+		if r, err = Encrypt(r, key); err != nil {
+			return nil, err
+		}
+		fields["e2e"] = "1"
+		fields["e2e_meta"] = meta
+		// the name is sealed in the meta information
+		name = "encrypted.bin"
+	}
+
+	// the fields have to come before the file, the server stores the file
+	// while it is being read
+	body, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		for field, value := range fields {
+			if value == "" {
+				continue
+			}
+			if err := mw.WriteField(field, value); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		part, err := mw.CreateFormFile("file", name)
+		if err == nil {
+			_, err = io.Copy(part, r)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, c.URL+"/", body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	body.Close()
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return nil, responseError(resp)
+	}
+	u := new(Upload)
+	if err := json.NewDecoder(resp.Body).Decode(u); err != nil {
+		return nil, err
+	}
+	u.Link = c.URL + "/" + escapePath(u.ID)
+	if key != nil {
+		u.Link += "#" + EncodeKey(key)
+	}
+	return u, nil
+}
+
+// Download writes the data of the share at link to w and returns the name
+// of the file. Links of encrypted files carry the key in the fragment, their
+// data is decrypted on the way.
+func (c *Client) Download(link string, password string, w io.Writer) (name string, err error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", err
+	}
+	id, name := path.Split(strings.Trim(u.Path, "/"))
+	id = strings.TrimPrefix(strings.TrimSuffix(id, "/"), "1/")
+	if id == "" || name == "" {
+		return "", errors.New("client: a share link looks like https://host/<id>/<name>")
+	}
+	raw := url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/1/" + id + "/" + name}
+	req, err := http.NewRequest(http.MethodGet, raw.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if password != "" {
+		req.Header.Set("X-Share-Password", password)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", responseError(resp)
+	}
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		name = params["filename"]
+	}
+
+	var data io.Reader = resp.Body
+	if sealed := resp.Header.Get("Webshare-Encrypted-Meta"); sealed != "" {
+		if u.Fragment == "" {
+			return "", errors.New("client: the file is encrypted and the link has no key")
+		}
+		key, err := DecodeKey(u.Fragment)
+		if err != nil {
+			return "", err
+		}
+		meta, err := OpenMeta(key, sealed)
+		if err != nil {
+			return "", err
+		}
+		if data, err = Decrypt(resp.Body, key); err != nil {
+			return "", err
+		}
+		name = meta.Name
+	}
+	_, err = io.Copy(w, data)
+	return path.Base("/" + name), err
+}
+
+// responseError returns the error message the server answered with.
+func responseError(resp *http.Response) error {
+	var body struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(b, &body) == nil && (body.Error != "" || body.Message != "") {
+		return fmt.Errorf("%s: %s%s", resp.Status, body.Error, body.Message)
+	}
+	return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+}
+
+func escapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	return strings.Join(parts, "/")
+}
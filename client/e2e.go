@@ -0,0 +1,243 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// End-to-end encrypted files are encrypted before they are uploaded, with a
+// key that only travels in the fragment of the share link, which browsers
+// never send to the server. The format is the one the web interface uses:
+//
+//	magic     8 bytes  "\x89WSE2E\r\n"
+//	chunks             up to 64 KiB of data each, sealed with AES-256-GCM
+//
+// The nonce of a chunk is its number with the last byte set to 1 for the
+// final chunk, so chunks can neither be reordered nor cut off. The name and
+// the content type of the file are sealed separately with the last byte of
+// the nonce set to 2, and stored by the server as they are.
+const (
+	// KeySize is the size of the keys of encrypted files.
+	KeySize = 32
+
+	chunkSize  = 64 << 10
+	tagSize    = 16
+	sealedSize = chunkSize + tagSize
+	nonceSize  = 12
+)
+
+// Magic starts every encrypted file.
+const Magic = "\x89WSE2E\r\n"
+
+// ErrDecrypt is returned for data that was tampered with or is decrypted
+// with the wrong key.
+var ErrDecrypt = errors.New("client: data can not be decrypted with this key")
+
+// Meta is what the server must not see of an encrypted file besides its data.
+type Meta struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// NewKey returns a random key for a new encrypted file.
+func NewKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	_, err := rand.Read(key)
+	return key, err
+}
+
+// EncodeKey encodes key for the fragment of a share link.
+func EncodeKey(key []byte) string {
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+// DecodeKey decodes a key taken from the fragment of a share link.
+func DecodeKey(s string) ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(key) != KeySize {
+		return nil, errors.New("client: invalid key")
+	}
+	return key, nil
+}
+
+// IsEncrypted reports whether data starts like an encrypted file.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(Magic))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, errors.New("client: invalid key")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func nonce(counter uint64, flag byte) []byte {
+	n := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(n[nonceSize-9:], counter)
+	n[nonceSize-1] = flag
+	return n
+}
+
+// SealMeta encrypts meta with key for the e2e_meta field of an upload.
+func SealMeta(key []byte, meta Meta) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nil, nonce(0, 2), data, nil)), nil
+}
+
+// OpenMeta decrypts the meta information sealed by SealMeta.
+func OpenMeta(key []byte, sealed string) (meta Meta, err error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return
+	}
+	b, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		return meta, ErrDecrypt
+	}
+	data, err := aead.Open(nil, nonce(0, 2), b, nil)
+	if err != nil {
+		return meta, ErrDecrypt
+	}
+	err = json.Unmarshal(data, &meta)
+	return
+}
+
+// Encrypt returns a reader of r encrypted with key.
+func Encrypt(r io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	e := &encrypter{src: bufio.NewReader(r), aead: aead, plain: make([]byte, chunkSize)}
+	return io.MultiReader(bytes.NewReader([]byte(Magic)), e), nil
+}
+
+type encrypter struct {
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	counter uint64
+	plain   []byte
+	buf     []byte
+	sealed  []byte
+	done    bool
+}
+
+func (e *encrypter) Read(p []byte) (int, error) {
+	for len(e.sealed) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		// a full chunk is only final if nothing follows, so only empty
+		// data ends with an empty chunk
+		n, err := io.ReadFull(e.src, e.plain)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			e.done = true
+		} else if err != nil {
+			return 0, err
+		} else if _, err := e.src.Peek(1); errors.Is(err, io.EOF) {
+			e.done = true
+		} else if err != nil {
+			return 0, err
+		}
+		var flag byte
+		if e.done {
+			flag = 1
+		}
+		e.buf = e.aead.Seal(e.buf[:0], nonce(e.counter, flag), e.plain[:n], nil)
+		e.sealed = e.buf
+		e.counter++
+	}
+	n := copy(p, e.sealed)
+	e.sealed = e.sealed[n:]
+	return n, nil
+}
+
+// Decrypt returns a reader of the data encrypted with key read from r. The
+// reader fails with ErrDecrypt if the data was tampered with, including
+// when it is cut off.
+func Decrypt(r io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	magic := make([]byte, len(Magic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != Magic {
+		return nil, errors.New("client: data is not encrypted")
+	}
+	return &decrypter{
+		src:    bufio.NewReaderSize(r, sealedSize+1),
+		aead:   aead,
+		sealed: make([]byte, sealedSize),
+		buf:    make([]byte, 0, chunkSize),
+	}, nil
+}
+
+type decrypter struct {
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	counter uint64
+	sealed  []byte
+	buf     []byte
+	plain   []byte
+	final   bool
+	err     error
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.final {
+			return 0, io.EOF
+		}
+		d.err = d.open()
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decrypter) open() error {
+	n, err := io.ReadFull(d.src, d.sealed)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		d.final = true
+	} else if err != nil {
+		return err
+	} else if _, err := d.src.Peek(1); errors.Is(err, io.EOF) {
+		d.final = true
+	} else if err != nil {
+		return err
+	}
+	var flag byte
+	if d.final {
+		flag = 1
+	}
+	d.buf, err = d.aead.Open(d.buf[:0], nonce(d.counter, flag), d.sealed[:n], nil)
+	if err != nil {
+		return ErrDecrypt
+	}
+	d.plain = d.buf
+	d.counter++
+	return nil
+}
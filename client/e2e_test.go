@@ -0,0 +1,152 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+)
+
+// testKey is the key of the known answers, the bytes 0 to 31.
+func testKey() []byte {
+	key := make([]byte, KeySize)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	return key
+}
+
+func testData(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+func encrypt(t *testing.T, key, data []byte) []byte {
+	t.Helper()
+	r, err := Encrypt(bytes.NewReader(data), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed
+}
+
+func decrypt(key, sealed []byte) ([]byte, error) {
+	r, err := Decrypt(bytes.NewReader(sealed), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestRoundTrip(t *testing.T) {
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 7} {
+		data := testData(size)
+		sealed := encrypt(t, key, data)
+		chunks := max(1, (size+chunkSize-1)/chunkSize)
+		if want := len(Magic) + size + chunks*tagSize; len(sealed) != want || !IsEncrypted(sealed) {
+			t.Errorf("%d bytes: encrypted to %d bytes, want %d starting with the magic", size, len(sealed), want)
+		}
+		got, err := decrypt(key, sealed)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: decrypted %d bytes, %v", size, len(got), err)
+		}
+	}
+
+	meta := Meta{Name: "report <final>.pdf", Type: "application/pdf"}
+	sealed, err := SealMeta(key, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := OpenMeta(key, sealed); err != nil || got != meta {
+		t.Errorf("OpenMeta: got %+v, %v, want %+v", got, err, meta)
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	key := testKey()
+	sealed := encrypt(t, key, testData(2*chunkSize+100))
+	first := len(Magic)
+	for _, tt := range []struct {
+		name   string
+		tamper func([]byte) []byte
+	}{
+		{"first chunk", func(b []byte) []byte { b[first+5] ^= 1; return b }},
+		{"tag of the final chunk", func(b []byte) []byte { b[len(b)-1] ^= 1; return b }},
+		{"final chunk dropped", func(b []byte) []byte { return b[:first+2*sealedSize] }},
+		{"cut inside a chunk", func(b []byte) []byte { return b[:first+sealedSize+10] }},
+		{"data appended", func(b []byte) []byte { return append(b, 0) }},
+		{"chunks reordered", func(b []byte) []byte {
+			a := bytes.Clone(b[first : first+sealedSize])
+			copy(b[first:], b[first+sealedSize:first+2*sealedSize])
+			copy(b[first+sealedSize:], a)
+			return b
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.tamper(bytes.Clone(sealed))
+			if _, err := decrypt(key, b); !errors.Is(err, ErrDecrypt) {
+				t.Errorf("got %v, want ErrDecrypt", err)
+			}
+		})
+	}
+
+	if _, err := decrypt(make([]byte, KeySize), sealed); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("wrong key: got %v, want ErrDecrypt", err)
+	}
+	if _, err := decrypt(key, []byte("plain text")); err == nil || errors.Is(err, ErrDecrypt) {
+		t.Errorf("data without the magic: got %v, want an error that it is not encrypted", err)
+	}
+	if _, err := OpenMeta(key, "AAAA"); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("OpenMeta: got %v, want ErrDecrypt", err)
+	}
+}
+
+// The known answers are encrypted by the functions of the web interface,
+// which have to agree with the client byte for byte.
+func TestKnownAnswers(t *testing.T) {
+	key := testKey()
+	for _, tt := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, "8957534532450d0a367ef8288831557408e102950a16e26a"},
+		{"small", []byte("hello, world\n"), "8957534532450d0a7db3d3902bd81069615c3d5de613f75638da5eac7a269e7f1522ddb5ac"},
+	} {
+		if got := hex.EncodeToString(encrypt(t, key, tt.data)); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+		want, _ := hex.DecodeString(tt.want)
+		if got, err := decrypt(key, want); err != nil || !bytes.Equal(got, tt.data) {
+			t.Errorf("%s: decrypted %q, %v, want %q", tt.name, got, err, tt.data)
+		}
+	}
+
+	// two chunks, which the web interface encrypted to 65586 bytes
+	sealed := encrypt(t, key, testData(chunkSize+10))
+	const want = "123076f9f385619501f07f6326f0956a683ad8af32b3f2a59b56c94ced10af60"
+	if sum := sha256.Sum256(sealed); len(sealed) != 65586 || hex.EncodeToString(sum[:]) != want {
+		t.Errorf("two chunks: got %d bytes with SHA-256 %x, want 65586 with %s", len(sealed), sum, want)
+	}
+
+	const meta = "slNAHNku-OubbBJlDzXJoKRjTKCLizWN-hgqTl6rN-WNTduy1IzcEVMgT4indsEw9RNndg"
+	if got, err := SealMeta(key, Meta{Name: "a.txt", Type: "text/plain"}); err != nil || got != meta {
+		t.Errorf("SealMeta: got %q, %v, want %q", got, err, meta)
+	}
+	if got, err := OpenMeta(key, meta); err != nil || got != (Meta{Name: "a.txt", Type: "text/plain"}) {
+		t.Errorf("OpenMeta: got %+v, %v", got, err)
+	}
+}
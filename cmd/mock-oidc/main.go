@@ -0,0 +1,35 @@
+// Command mock-oidc is an OpenID Connect provider for trying out and testing
+// the sign in of webshare without a real identity provider. It signs in
+// whoever asks as whatever email address and groups they enter, so it must
+// never be reachable from the outside.
+//
+//	mock-oidc -addr localhost:8400 &
+//	webshare -oidc-issuer http://localhost:8400 -oidc-allowed-groups staff
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/tuilakhanh/webshare/internal/mockoidc"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:8400", "address to listen on")
+	issuer := flag.String("issuer", "", "issuer URL (default http://<addr>)")
+	clientID := flag.String("client-id", "webshare", "the only client ID accepted")
+	clientSecret := flag.String("client-secret", "", "secret of the client, empty for a public client")
+	flag.Parse()
+	if *issuer == "" {
+		*issuer = "http://" + *addr
+	}
+
+	p, err := mockoidc.New(*clientID, *clientSecret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p.Issuer = *issuer
+	log.Printf("mock OpenID Connect provider %s listening on %s", *issuer, *addr)
+	log.Fatal(http.ListenAndServe(*addr, p))
+}
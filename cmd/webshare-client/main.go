@@ -0,0 +1,119 @@
+// Command webshare-client uploads files to a webshare server and downloads
+// them, optionally encrypted end-to-end.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+
+	"github.com/tuilakhanh/webshare/client"
+)
+
+func main() {
+	server := flag.String("server", envOr("WEBSHARE_URL", "http://localhost:8222"), "URL of the server, $WEBSHARE_URL if set")
+	token := flag.String("token", "", "API token to upload with (default $WEBSHARE_TOKEN)")
+	encrypt := flag.Bool("e2e", false, "encrypt the file end-to-end, the key is only put into the printed link")
+	password := flag.String("password", "", "password protecting the file")
+	maxDownloads := flag.Int("max-downloads", 0, "delete the file after this many downloads")
+	expires := flag.String("expires", "", "when to delete the file, e.g. 1h, 7d or an RFC 3339 time")
+	output := flag.String("o", "", "file to download to, - for stdout (default the name of the shared file)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n  %[1]s [options] upload FILE\n  %[1]s [options] download LINK\n\nOptions:\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c := client.New(*server)
+	// the token is not the default of the flag, usage would print it
+	c.Token = *token
+	if c.Token == "" {
+		c.Token = os.Getenv("WEBSHARE_TOKEN")
+	}
+	var err error
+	switch flag.Arg(0) {
+	case "upload":
+		err = upload(c, flag.Arg(1), client.UploadOptions{
+			Encrypt:      *encrypt,
+			Password:     *password,
+			MaxDownloads: *maxDownloads,
+			Expires:      *expires,
+		})
+	case "download":
+		err = download(c, flag.Arg(1), *password, *output)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func upload(c *client.Client, file string, opts client.UploadOptions) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	opts.ContentType = mime.TypeByExtension(filepath.Ext(file))
+	u, err := c.Upload(filepath.Base(file), f, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Println(u.Link)
+	fmt.Fprintf(os.Stderr, "delete token: %s\nexpires: %s\n", u.DeleteToken, u.ExpiresAt.Local().Format("2006-01-02 15:04"))
+	return nil
+}
+
+func download(c *client.Client, link string, password string, output string) error {
+	// the name is only known once the download started, so it is written
+	// to a temporary file first
+	tmp, err := os.CreateTemp(".", ".webshare-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	name, err := c.Download(link, password, tmp)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	switch output {
+	case "-":
+		f, err := os.Open(tmp.Name())
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(os.Stdout, f)
+		return err
+	case "":
+		output = name
+	}
+	if err := os.Rename(tmp.Name(), output); err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, output)
+	return nil
+}
+
+func envOr(key string, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
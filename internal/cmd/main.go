@@ -1,18 +1,268 @@
 package cmd
 
 import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/dustin/go-humanize"
 	"github.com/rs/zerolog/log"
 
 	"github.com/tuilakhanh/webshare/internal/config"
 	"github.com/tuilakhanh/webshare/internal/handlers"
+	"github.com/tuilakhanh/webshare/internal/pkg"
+	"github.com/tuilakhanh/webshare/internal/storage"
 )
 
 func Main() {
 	cfg := config.LoadConfig()
-	server := handlers.NewServer(cfg)
+	if _, err := pkg.NewIDGenerator(*cfg); err != nil {
+		log.Fatal().Err(err).Msg("Invalid ID options")
+	}
+	if _, err := pkg.NewRetentionPolicy(*cfg); err != nil {
+		log.Fatal().Err(err).Msg("Invalid retention options")
+	}
+
+	switch cfg.Codec {
+	case "none", pkg.CodecGzip, pkg.CodecZstd:
+	default:
+		log.Fatal().Str("codec", cfg.Codec).Msg("Unknown codec")
+	}
+
+	if _, ok := handlers.EvictionPolicies[cfg.Eviction]; !ok {
+		log.Fatal().Str("eviction", cfg.Eviction).Msg("Unknown eviction policy")
+	}
+
+	switch cfg.ActiveContent {
+	case "attachment", "text":
+	default:
+		log.Fatal().Str("active_content", cfg.ActiveContent).Msg("Unknown way to serve active content")
+	}
+	if cfg.UserContentURL != "" {
+		u, err := url.Parse(cfg.UserContentURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" {
+			log.Fatal().Str("usercontent", cfg.UserContentURL).Msg("The usercontent origin must be a URL like https://usercontent.example.com")
+		}
+	}
+
+	if flag.Arg(0) == "generate-key" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatal().Err(err).Msg("Error generating key")
+		}
+		fmt.Println(hex.EncodeToString(key))
+		return
+	}
+
+	store, err := openStorage(cfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error opening storage")
+	}
+	keys, err := loadKeyring(cfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid encryption keys")
+	}
+	var encrypted *storage.Encrypted
+	if keys != nil {
+		encrypted = storage.NewEncrypted(store, keys)
+		encrypted.ReadUnencrypted = cfg.ReadUnencrypted
+		store = encrypted
+	}
+	// the retention dry-run, the key rotation, the token and the account
+	// commands use the storage itself, so that they also work while the
+	// server holds the index. The index reads auth/ from the storage, so a
+	// running server sees the tokens and accounts they change right away.
+	storageCommands := []string{"retention", "rotate-keys", "create-token", "list-tokens", "revoke-token",
+		"create-user", "set-password", "set-quota", "delete-user", "list-users"}
+	if cfg.IndexFile != "" && !slices.Contains(storageCommands, flag.Arg(0)) {
+		index, err := handlers.OpenIndex(cfg.IndexFile, store, keys)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error opening index")
+		}
+		defer index.Close()
+		store = index
+	}
+	server := handlers.NewServer(cfg, store)
+
+	switch flag.Arg(0) {
+	case "":
+	case "rebuild-index":
+		index, ok := store.(*handlers.Index)
+		if !ok {
+			log.Fatal().Msg("No index configured")
+		}
+		if err := index.Rebuild(); err != nil {
+			log.Fatal().Err(err).Msg("Error rebuilding index")
+		}
+		return
+	case "rotate-keys":
+		if encrypted == nil {
+			log.Fatal().Msg("No encryption key configured")
+		}
+		n, err := encrypted.RotateKeys()
+		if err != nil {
+			log.Fatal().Err(err).Int("objects", n).Msg("Error rotating keys")
+		}
+		log.Info().Int("objects", n).Msg("Rotated keys")
+		if cfg.IndexFile == "" {
+			return
+		}
+		// the objects that were not encrypted before have grown
+		index, err := handlers.OpenIndex(cfg.IndexFile, store, keys)
+		if err != nil {
+			log.Warn().Err(err).Msg("Index not updated, run rebuild-index once the server is stopped")
+			return
+		}
+		defer index.Close()
+		if err := index.Rebuild(); err != nil {
+			log.Fatal().Err(err).Msg("Error rebuilding index")
+		}
+		return
+	case "create-token":
+		if flag.NArg() != 2 || strings.TrimSpace(flag.Arg(1)) == "" {
+			log.Fatal().Msg("Usage: create-token NAME")
+		}
+		token, err := server.CreateToken(flag.Arg(1))
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error creating API token")
+		}
+		fmt.Println(token)
+		return
+	case "list-tokens":
+		if err := server.PrintTokens(os.Stdout); err != nil {
+			log.Fatal().Err(err).Msg("Error listing API tokens")
+		}
+		return
+	case "revoke-token":
+		if flag.NArg() != 2 {
+			log.Fatal().Msg("Usage: revoke-token ID")
+		}
+		if err := server.RevokeToken(flag.Arg(1)); err != nil {
+			log.Fatal().Err(err).Msg("Error revoking API token")
+		}
+		log.Info().Str("token", flag.Arg(1)).Msg("Revoked API token")
+		return
+	case "create-user", "set-password":
+		if flag.NArg() != 2 {
+			log.Fatal().Msgf("Usage: %s NAME", flag.Arg(0))
+		}
+		password, err := readPassword()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error reading password")
+		}
+		if flag.Arg(0) == "create-user" {
+			err = server.CreateUser(flag.Arg(1), password)
+		} else {
+			err = server.SetPassword(flag.Arg(1), password)
+		}
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error saving account")
+		}
+		log.Info().Str("user", flag.Arg(1)).Msg("Saved account")
+		return
+	case "set-quota":
+		if flag.NArg() != 3 {
+			log.Fatal().Msg("Usage: set-quota NAME SIZE")
+		}
+		quota := int64(-1)
+		if flag.Arg(2) != "-1" {
+			size, err := humanize.ParseBytes(flag.Arg(2))
+			if err != nil {
+				log.Fatal().Err(err).Msg("Invalid quota")
+			}
+			quota = int64(size)
+		}
+		if err := server.SetQuota(flag.Arg(1), quota); err != nil {
+			log.Fatal().Err(err).Msg("Error saving account")
+		}
+		log.Info().Str("user", flag.Arg(1)).Int64("quota", quota).Msg("Saved account")
+		return
+	case "delete-user":
+		if flag.NArg() != 2 {
+			log.Fatal().Msg("Usage: delete-user NAME")
+		}
+		if err := server.DeleteUser(flag.Arg(1)); err != nil {
+			log.Fatal().Err(err).Msg("Error deleting account")
+		}
+		log.Info().Str("user", flag.Arg(1)).Msg("Deleted account")
+		return
+	case "list-users":
+		if err := server.PrintUsers(os.Stdout); err != nil {
+			log.Fatal().Err(err).Msg("Error listing accounts")
+		}
+		return
+	case "retention":
+		if err := server.PrintRetention(os.Stdout); err != nil {
+			log.Fatal().Err(err).Msg("Error listing files")
+		}
+		return
+	default:
+		log.Fatal().Str("command", flag.Arg(0)).Msg("Unknown command")
+	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	log.Info().Msgf("Starting server on :%s", cfg.Port)
-	if err := server.Start(); err != nil {
+	if err := server.Start(ctx); err != nil {
 		log.Fatal().Err(err).Msg("Error starting server")
 	}
 }
+
+// loadKeyring returns the encryption keys from the config, nil if there are
+// none.
+func loadKeyring(cfg *config.Config) (*storage.Keyring, error) {
+	keys := cfg.EncryptionKey
+	if cfg.EncryptionKeyFile != "" {
+		b, err := os.ReadFile(cfg.EncryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		keys += "\n" + string(b)
+	}
+	if strings.TrimSpace(keys) == "" {
+		return nil, nil
+	}
+	return storage.ParseKeyring(keys)
+}
+
+// openStorage returns the storage backend selected in the config.
+func openStorage(cfg *config.Config) (storage.Storage, error) {
+	switch cfg.Storage {
+	case "local":
+		return storage.NewLocal(cfg.ContentDirectory)
+	case "s3":
+		return storage.NewS3(storage.S3Options{
+			Endpoint:  cfg.S3Endpoint,
+			Region:    cfg.S3Region,
+			Bucket:    cfg.S3Bucket,
+			Prefix:    cfg.S3Prefix,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+			Insecure:  cfg.S3Insecure,
+		})
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", cfg.Storage)
+}
+
+// readPassword reads a password from the first line of standard input,
+// asking for it if that is a terminal.
+func readPassword() (string, error) {
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(os.Stderr, "Password: ")
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
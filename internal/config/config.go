@@ -1,8 +1,13 @@
 package config
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"flag"
+	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/rs/zerolog"
@@ -11,13 +16,57 @@ import (
 
 type Config struct {
 	PublicURL            string
+	UserContentURL       string
+	ActiveContent        string
 	ContentDirectory     string
+	UploadDirectory      string
+	IndexFile            string
+	UploadExpiry         time.Duration
 	Debug                bool
 	Port                 string
+	TrustedProxies       string
 	MaxBytesTotal        int64
 	MaxBytesPerFile      int64
 	MaxBytesPerFileHuman string
+	Eviction             string
 	MinutesPerGigabyte   float64
+	RetentionCurve       string
+	MinRetention         time.Duration
+	MaxRetention         time.Duration
+	RetentionOverrides   string
+	IDAlphabet           string
+	Codec                string
+	CompressionThreshold float64
+	BLAKE3               bool
+	IDLength             int
+	AllowGetDelete       bool
+	RequireAuth          bool
+	Accounts             bool
+	UserQuota            int64
+	Secret               string
+	EncryptionKey        string
+	EncryptionKeyFile    string
+	ReadUnencrypted      bool
+	UnlockDuration       time.Duration
+
+	// OpenID Connect login of the web interface, enabled by OIDCIssuer
+	OIDCIssuer        string
+	OIDCClientID      string
+	OIDCClientSecret  string
+	OIDCAllowedEmails string
+	OIDCAllowedGroups string
+	OIDCGroupsClaim   string
+	SessionDuration   time.Duration
+
+	// Storage backend, either "local" or "s3"
+	Storage     string
+	S3Endpoint  string
+	S3Region    string
+	S3Bucket    string
+	S3Prefix    string
+	S3AccessKey string
+	S3SecretKey string
+	S3Insecure  bool
 }
 
 func LoadConfig() *Config {
@@ -25,12 +74,70 @@ func LoadConfig() *Config {
 
 	// Flag variables
 	flag.StringVar(&cfg.ContentDirectory, "data", "data", "data directory")
+	flag.StringVar(&cfg.UploadDirectory, "uploads", "uploads", "directory for resumable uploads in progress")
+	flag.StringVar(&cfg.IndexFile, "index", "index.db", "file of the metadata index, empty to read the metadata from the storage every time")
+	flag.DurationVar(&cfg.UploadExpiry, "upload-expiry", 24*time.Hour, "time after which unfinished resumable uploads are deleted")
 	flag.StringVar(&cfg.PublicURL, "public", "", "public URL to use")
+	flag.StringVar(&cfg.UserContentURL, "usercontent", "", "separate origin to serve the uploaded files from, e.g. https://usercontent.example.com")
+	flag.StringVar(&cfg.ActiveContent, "active-content", "attachment", "how to serve HTML, SVG, XML and scripts at the origin of the site: attachment or text")
 	flag.StringVar(&cfg.Port, "port", "8222", "port to use")
+	flag.StringVar(&cfg.TrustedProxies, "trusted-proxies", "", "addresses or CIDR ranges of the reverse proxies in front, separated by commas, whose X-Forwarded-For header tells the address of the client")
 	flag.BoolVar(&cfg.Debug, "debug", false, "debug mode")
 	flag.Int64Var(&cfg.MaxBytesPerFile, "max-file", 1000000000, "max bytes per file")
 	flag.Int64Var(&cfg.MaxBytesTotal, "max-total", 10000000000, "max bytes total")
-	flag.Float64Var(&cfg.MinutesPerGigabyte, "min-per-gig", 60, "minutes per gigabyte for auto-deletion")
+	flag.StringVar(&cfg.Eviction, "eviction", "largest", "which files to delete first when max-total is exceeded: largest, oldest, lru, expiry or weighted")
+	flag.Float64Var(&cfg.MinutesPerGigabyte, "min-per-gig", 60, "minutes per gigabyte for auto-deletion (inverse retention curve)")
+	flag.StringVar(&cfg.RetentionCurve, "retention-curve", "inverse", "how retention scales with the file size: inverse, linear or cubic")
+	flag.DurationVar(&cfg.MinRetention, "min-retention", 0, "minimum time files are kept")
+	flag.DurationVar(&cfg.MaxRetention, "max-retention", 365*24*time.Hour, "maximum time files are kept")
+	flag.StringVar(&cfg.RetentionOverrides, "retention-overrides", "", "retention per content type, e.g. \"image/*=720h,application/pdf=1h..48h\"")
+	flag.StringVar(&cfg.Codec, "codec", "gzip", "codec to compress uploads with: gzip, zstd or none")
+	flag.Float64Var(&cfg.CompressionThreshold, "compress-threshold", 0.9, "store uploads uncompressed if their first 64kB compress to more than this ratio")
+	flag.BoolVar(&cfg.BLAKE3, "blake3", false, "compute BLAKE3 checksums of uploads in addition to SHA-256")
+	flag.StringVar(&cfg.IDAlphabet, "id-alphabet", "base58", "alphabet of the share IDs: base58, digits, hex, words or a custom set of characters")
+	flag.IntVar(&cfg.IDLength, "id-length", 8, "length of the share IDs (number of words for the words alphabet)")
+	flag.BoolVar(&cfg.AllowGetDelete, "allow-get-delete", false, "enable the old GET /delete/:id route that deletes without a delete token, for old clients only")
+	flag.BoolVar(&cfg.RequireAuth, "require-auth", false, "only accept uploads authenticated with an API token, downloads stay public")
+	flag.BoolVar(&cfg.Accounts, "accounts", false, "let users sign in to the web interface with the local accounts made by create-user")
+	flag.Int64Var(&cfg.UserQuota, "quota", 0, "max bytes of the files of each signed in user or API token, 0 for no limit")
+	flag.StringVar(&cfg.Secret, "secret", os.Getenv("WEBSHARE_SECRET"), "secret to sign cookies with (default $WEBSHARE_SECRET, random if empty)")
+	flag.StringVar(&cfg.EncryptionKey, "encryption-key", os.Getenv("WEBSHARE_ENCRYPTION_KEY"), "master keys to encrypt the stored files with, 32 bytes in hex or base64 separated by commas, the first one encrypts new files (default $WEBSHARE_ENCRYPTION_KEY)")
+	flag.StringVar(&cfg.EncryptionKeyFile, "encryption-key-file", "", "file with more master keys, one per line, used after the ones of encryption-key")
+	flag.BoolVar(&cfg.ReadUnencrypted, "read-unencrypted", false, "serve the files stored before encryption was enabled as they are, only until rotate-keys has encrypted them")
+	flag.DurationVar(&cfg.UnlockDuration, "unlock-duration", time.Hour, "how long an entered share password stays valid")
+	flag.StringVar(&cfg.OIDCIssuer, "oidc-issuer", "", "URL of the OpenID Connect provider to sign in to the web interface with, uploading then requires signing in, the provider must mark the email addresses verified")
+	flag.StringVar(&cfg.OIDCClientID, "oidc-client-id", "webshare", "client ID registered with the OpenID Connect provider")
+	flag.StringVar(&cfg.OIDCClientSecret, "oidc-client-secret", os.Getenv("WEBSHARE_OIDC_CLIENT_SECRET"), "client secret registered with the OpenID Connect provider, empty for a public client (default $WEBSHARE_OIDC_CLIENT_SECRET)")
+	flag.StringVar(&cfg.OIDCAllowedEmails, "oidc-allowed-emails", "", "email addresses allowed to sign in separated by commas, @example.com allows a whole domain")
+	flag.StringVar(&cfg.OIDCAllowedGroups, "oidc-allowed-groups", "", "groups allowed to sign in separated by commas, everyone the provider authenticates if neither emails nor groups are given")
+	flag.StringVar(&cfg.OIDCGroupsClaim, "oidc-groups-claim", "groups", "claim of the ID token listing the groups of the user")
+	flag.DurationVar(&cfg.SessionDuration, "session-duration", 12*time.Hour, "how long a sign in to the web interface lasts")
+	flag.StringVar(&cfg.Storage, "storage", "local", "storage backend to use (local or s3)")
+	flag.StringVar(&cfg.S3Endpoint, "s3-endpoint", "s3.amazonaws.com", "S3 endpoint (host[:port])")
+	flag.StringVar(&cfg.S3Region, "s3-region", "", "S3 region")
+	flag.StringVar(&cfg.S3Bucket, "s3-bucket", "webshare", "S3 bucket")
+	flag.StringVar(&cfg.S3Prefix, "s3-prefix", "", "prefix of the objects in the S3 bucket")
+	flag.StringVar(&cfg.S3AccessKey, "s3-access-key", os.Getenv("S3_ACCESS_KEY"), "S3 access key (default $S3_ACCESS_KEY, then $AWS_ACCESS_KEY_ID)")
+	flag.StringVar(&cfg.S3SecretKey, "s3-secret-key", os.Getenv("S3_SECRET_KEY"), "S3 secret key (default $S3_SECRET_KEY, then $AWS_SECRET_ACCESS_KEY)")
+	flag.BoolVar(&cfg.S3Insecure, "s3-insecure", false, "connect to the S3 endpoint without TLS")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [command]\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Commands:")
+		fmt.Fprintln(flag.CommandLine.Output(), "  retention\tprint when the stored files expire, without deleting anything")
+		fmt.Fprintln(flag.CommandLine.Output(), "  rebuild-index\trebuild the metadata index from the storage")
+		fmt.Fprintln(flag.CommandLine.Output(), "  generate-key\tprint a new random encryption key")
+		fmt.Fprintln(flag.CommandLine.Output(), "  create-token NAME\tcreate an API token to upload with and print it")
+		fmt.Fprintln(flag.CommandLine.Output(), "  list-tokens\tprint the API tokens and the files uploaded with them")
+		fmt.Fprintln(flag.CommandLine.Output(), "  revoke-token ID\trevoke the API token with the given ID, its files are kept")
+		fmt.Fprintln(flag.CommandLine.Output(), "  create-user NAME\tcreate a local account, the password is read from standard input")
+		fmt.Fprintln(flag.CommandLine.Output(), "  set-password NAME\tchange the password of a local account, read from standard input, and end its sessions")
+		fmt.Fprintln(flag.CommandLine.Output(), "  set-quota NAME SIZE\tset the quota of a local account, like 10GB, 0 for the default of the quota option or -1 for no limit")
+		fmt.Fprintln(flag.CommandLine.Output(), "  delete-user NAME\tdelete a local account, its files are kept")
+		fmt.Fprintln(flag.CommandLine.Output(), "  list-users\tprint the local accounts and how much they store")
+		fmt.Fprintln(flag.CommandLine.Output(), "  rotate-keys\tencrypt the keys of all stored files with the first encryption key, and encrypt the files stored without one")
+		fmt.Fprintln(flag.CommandLine.Output(), "\nOptions:")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	// Initialize Zerolog with console writer and log level (if you want to keep this logic here)
@@ -44,6 +151,13 @@ func LoadConfig() *Config {
 
 	// Initialize config
 	cfg.MaxBytesPerFileHuman = humanize.Bytes(uint64(cfg.MaxBytesPerFile))
+	if cfg.Secret == "" {
+		// cookies signed with it become invalid on restart
+		b := make([]byte, 32)
+		rand.Read(b)
+		cfg.Secret = hex.EncodeToString(b)
+	}
+	cfg.UserContentURL = strings.TrimSuffix(cfg.UserContentURL, "/")
 	if cfg.PublicURL == "" {
 		cfg.PublicURL = "http://localhost:" + cfg.Port
 	}
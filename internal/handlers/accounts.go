@@ -0,0 +1,479 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/tuilakhanh/webshare/internal/storage"
+)
+
+// Local accounts let users sign in to the web interface with a name and a
+// password. They are managed with the admin commands and stored next to the
+// API tokens:
+//
+//	auth/users/<name>.json.gz
+//
+// Signed in users and API tokens can list the files they uploaded, and their
+// uploads count against a storage quota.
+
+func accountKey(name string) string {
+	return path.Join(authDir, "users", name+".json.gz")
+}
+
+// accountName is what account names may look like, they end up in storage
+// keys.
+var accountName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,31}$`)
+
+// Account is a local account as stored.
+type Account struct {
+	Name         string
+	PasswordHash string
+	// PasswordGeneration counts the changes of the password, the sessions
+	// signed in with an older one end
+	PasswordGeneration int
+	Created            time.Time
+	// Quota is the number of bytes the files of the account may take, 0 for
+	// the quota of the config and negative for no limit
+	Quota int64
+}
+
+// Uploader returns the identity recorded in the files uploaded by a.
+func (a *Account) Uploader() string {
+	return "user:" + a.Name
+}
+
+var errNoAccount = errors.New("no such account")
+
+// loadAccount returns the account called name.
+func loadAccount(store storage.Storage, name string) (*Account, error) {
+	if !accountName.MatchString(name) {
+		return nil, errNoAccount
+	}
+	a := new(Account)
+	if err := readGzippedJSON(a, accountKey(name), store); errors.Is(err, storage.ErrNotExist) {
+		return nil, errNoAccount
+	} else if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// CreateUser stores a new account.
+func (s *Server) CreateUser(name string, password string) error {
+	if !accountName.MatchString(name) {
+		return fmt.Errorf("invalid name %q, use up to 32 lowercase letters, digits, dots, dashes and underscores", name)
+	}
+	if password == "" {
+		return errors.New("the password must not be empty")
+	}
+	if exists, err := storage.Exists(s.store, accountKey(name)); err != nil {
+		return err
+	} else if exists {
+		return fmt.Errorf("account %q exists already", name)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return writeGzippedJSON(&Account{Name: name, PasswordHash: hash, Created: time.Now()}, accountKey(name), s.store)
+}
+
+// SetPassword changes the password of the account called name, which ends
+// its sessions.
+func (s *Server) SetPassword(name string, password string) error {
+	if password == "" {
+		return errors.New("the password must not be empty")
+	}
+	return s.updateAccount(name, func(a *Account) (err error) {
+		a.PasswordHash, err = hashPassword(password)
+		a.PasswordGeneration++
+		return
+	})
+}
+
+// SetQuota changes the quota of the account called name.
+func (s *Server) SetQuota(name string, quota int64) error {
+	return s.updateAccount(name, func(a *Account) error {
+		a.Quota = quota
+		return nil
+	})
+}
+
+func (s *Server) updateAccount(name string, update func(*Account) error) error {
+	a, err := loadAccount(s.store, name)
+	if errors.Is(err, errNoAccount) {
+		return fmt.Errorf("no account called %q", name)
+	} else if err != nil {
+		return err
+	}
+	if err := update(a); err != nil {
+		return err
+	}
+	return writeGzippedJSON(a, accountKey(name), s.store)
+}
+
+// DeleteUser deletes the account called name, which ends its sessions. The
+// files uploaded by it are kept.
+func (s *Server) DeleteUser(name string) error {
+	if _, err := loadAccount(s.store, name); errors.Is(err, errNoAccount) {
+		return fmt.Errorf("no account called %q", name)
+	} else if err != nil {
+		return err
+	}
+	return s.store.Delete(accountKey(name))
+}
+
+// loadAccounts returns all accounts sorted by name.
+func loadAccounts(store storage.Storage) ([]*Account, error) {
+	names, err := store.List(path.Join(authDir, "users"))
+	if err != nil {
+		return nil, err
+	}
+	var accounts []*Account
+	for _, name := range names {
+		name, ok := strings.CutSuffix(name, ".json.gz")
+		if !ok {
+			continue
+		}
+		a, err := loadAccount(store, name)
+		if errors.Is(err, errNoAccount) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, a)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Name < accounts[j].Name })
+	return accounts, nil
+}
+
+// PrintUsers writes the accounts along with how much they store.
+func (s *Server) PrintUsers(w io.Writer) error {
+	accounts, err := loadAccounts(s.store)
+	if err != nil {
+		return err
+	}
+	uploads, err := s.allUploads()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tCREATED\tFILES\tUSED\tQUOTA")
+	for _, a := range accounts {
+		quota := "-"
+		if limit := s.quotaOf(a); limit > 0 {
+			quota = humanize.Bytes(uint64(limit))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n",
+			a.Name, a.Created.Local().Format(time.DateTime), len(uploads[a.Uploader()]),
+			humanize.Bytes(usage(uploads[a.Uploader()])), quota)
+	}
+	return tw.Flush()
+}
+
+// allUploads returns the stored files by the identity they were uploaded
+// with, anonymous uploads left out. It reads the meta information of every
+// file, which only the admin commands can afford.
+func (s *Server) allUploads() (map[string][]*Page, error) {
+	ids, err := s.store.List("")
+	if err != nil {
+		return nil, err
+	}
+	uploads := make(map[string][]*Page)
+	for _, id := range ids {
+		if !isFileID(id) {
+			continue
+		}
+		p, err := loadPageInfo(id, *s.config, s.store)
+		if err != nil || p.Uploader == "" {
+			continue
+		}
+		uploads[p.Uploader] = append(uploads[p.Uploader], p)
+	}
+	return uploads, nil
+}
+
+// uploadsOf returns the stored files uploaded by identity, newest first.
+// Without an index, all files are read to find them.
+func (s *Server) uploadsOf(identity string) ([]*Page, error) {
+	idx, ok := s.store.(*Index)
+	if !ok {
+		uploads, err := s.allUploads()
+		if err != nil {
+			return nil, err
+		}
+		return sortUploads(uploads[identity]), nil
+	}
+	ids, _ := idx.Uploads(identity)
+	var pages []*Page
+	for _, id := range ids {
+		if p, err := loadPageInfo(id, *s.config, s.store); err == nil {
+			pages = append(pages, p)
+		}
+	}
+	return sortUploads(pages), nil
+}
+
+// sortUploads sorts pages newest first.
+func sortUploads(pages []*Page) []*Page {
+	sort.Slice(pages, func(i, j int) bool { return pages[i].Modified.After(pages[j].Modified) })
+	return pages
+}
+
+// usageOf returns the bytes taken by the files uploaded by identity.
+func (s *Server) usageOf(identity string) (uint64, error) {
+	if idx, ok := s.store.(*Index); ok {
+		_, size := idx.Uploads(identity)
+		return size, nil
+	}
+	pages, err := s.uploadsOf(identity)
+	return usage(pages), err
+}
+
+// usage returns the bytes taken by pages. Deduplicated files count fully
+// for every upload, users can not tell they share their data.
+func usage(pages []*Page) (size uint64) {
+	for _, p := range pages {
+		size += p.Size
+	}
+	return
+}
+
+// quotaOf returns the quota of a in bytes, 0 for no limit.
+func (s *Server) quotaOf(a *Account) int64 {
+	switch {
+	case a.Quota < 0:
+		return 0
+	case a.Quota > 0:
+		return a.Quota
+	}
+	return s.config.UserQuota
+}
+
+// quota returns the quota of identity in bytes, 0 for no limit. Anonymous
+// uploads have none, they are limited by the max file size only.
+func (s *Server) quota(identity string) (int64, error) {
+	kind, name, _ := strings.Cut(identity, ":")
+	switch kind {
+	case "":
+		return 0, nil
+	case "user":
+		a, err := loadAccount(s.store, name)
+		if err != nil {
+			return 0, err
+		}
+		return s.quotaOf(a), nil
+	}
+	return s.config.UserQuota, nil
+}
+
+// remainingQuota returns how many more bytes identity may upload, limited
+// is false if there is no quota. The quota is checked before every upload,
+// a form upload holds back its size while it is stored and a resumable one
+// is checked once more when it is finished, see reserveQuota.
+func (s *Server) remainingQuota(identity string) (remaining int64, limited bool, err error) {
+	s.reservedMu.Lock()
+	defer s.reservedMu.Unlock()
+	return s.remainingQuotaLocked(identity)
+}
+
+func (s *Server) remainingQuotaLocked(identity string) (remaining int64, limited bool, err error) {
+	quota, err := s.quota(identity)
+	if err != nil || quota == 0 {
+		return
+	}
+	used, err := s.usageOf(identity)
+	if err != nil {
+		return
+	}
+	return quota - int64(used) - s.reserved[identity], true, nil
+}
+
+// quotaError is returned for an upload that does not fit the quota.
+type quotaError struct {
+	remaining int64
+}
+
+func (e *quotaError) Error() string {
+	return quotaMessage(e.remaining)
+}
+
+// reserveQuota counts size more bytes against the quota of identity until
+// release is called, once the upload they are for is stored or failed. It
+// returns a *quotaError if they do not fit, so that uploads finishing at the
+// same time can not overshoot the quota together.
+func (s *Server) reserveQuota(identity string, size int64) (release func(), err error) {
+	s.reservedMu.Lock()
+	defer s.reservedMu.Unlock()
+	remaining, limited, err := s.remainingQuotaLocked(identity)
+	if err != nil {
+		return nil, err
+	}
+	if !limited {
+		return func() {}, nil
+	}
+	if size > remaining {
+		return nil, &quotaError{remaining}
+	}
+	s.reserved[identity] += size
+	return func() {
+		s.reservedMu.Lock()
+		defer s.reservedMu.Unlock()
+		if s.reserved[identity] -= size; s.reserved[identity] == 0 {
+			delete(s.reserved, identity)
+		}
+	}, nil
+}
+
+// quotaMessage tells why an upload does not fit the quota.
+func quotaMessage(remaining int64) string {
+	if remaining <= 0 {
+		return "Your storage quota is used up, delete some of your files first."
+	}
+	return fmt.Sprintf("Upload exceeds your storage quota, %s left.", humanize.Bytes(uint64(remaining)))
+}
+
+// dummyPasswordHash is what the password of an unknown name is compared
+// to, so that it takes as long to reject as a wrong password and does not
+// tell which accounts exist.
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("webshare"), bcrypt.DefaultCost)
+	return hash
+})
+
+// handlePasswordLogin signs in with a local account. Wrong passwords are
+// limited per name and client, so that guessing from elsewhere does not
+// lock the owner of the account out.
+func (s *Server) handlePasswordLogin(c *gin.Context) {
+	name := c.PostForm("username")
+	limit := "user:" + name + "|" + c.ClientIP()
+	if !s.passwordLimiter.allow(limit) {
+		log.Warn().Str("user", name).Msg("Too many wrong passwords")
+		s.showLoginError(c, http.StatusTooManyRequests, errTooManyAttempts.Error())
+		return
+	}
+	a, err := loadAccount(s.store, name)
+	if err != nil && !errors.Is(err, errNoAccount) {
+		log.Error().Err(err).Str("user", name).Msg("Error loading account")
+		s.showLoginError(c, http.StatusInternalServerError, "Signing in failed.")
+		return
+	}
+	hash := dummyPasswordHash()
+	if a != nil {
+		hash = []byte(a.PasswordHash)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(c.PostForm("password"))) != nil || a == nil {
+		s.passwordLimiter.fail(limit)
+		s.showLoginError(c, http.StatusUnauthorized, "Wrong name or password.")
+		return
+	}
+
+	log.Info().Str("user", name).Msg("Signed in")
+	s.startSession(c, session{Identity: a.Uploader(), PasswordGeneration: a.PasswordGeneration})
+	c.Redirect(http.StatusSeeOther, safeRedirect(c.PostForm("next")))
+}
+
+// handleMyUploads shows the files of the signed in user.
+func (s *Server) handleMyUploads(c *gin.Context) {
+	p := s.homePage(c)
+	identity := s.sessionIdentity(c)
+	if identity == "" {
+		if !s.signInEnabled() {
+			c.Redirect(http.StatusSeeOther, "/")
+			return
+		}
+		p.SignInRequired = true
+		p.Error = "Sign in to see your files."
+		c.Status(http.StatusUnauthorized)
+		p.handleGetHome(c.Writer, s.indexTemplate)
+		return
+	}
+
+	uploads, err := s.uploadsOf(identity)
+	if err != nil {
+		log.Error().Err(err).Str("user", identity).Msg("Error listing uploads")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	for _, upload := range uploads {
+		s.countDownloads(upload)
+	}
+	quota, err := s.quota(identity)
+	if err != nil {
+		log.Error().Err(err).Str("user", identity).Msg("Error loading quota")
+	}
+	p.MyUploads = true
+	p.Uploads = uploads
+	p.Usage = humanize.Bytes(usage(uploads))
+	if quota > 0 {
+		p.Usage += " of " + humanize.Bytes(uint64(quota))
+	}
+	p.handleGetHome(c.Writer, s.indexTemplate)
+}
+
+// handleUploadsAPI lists the files of the API token or signed in user.
+func (s *Server) handleUploadsAPI(c *gin.Context) {
+	identity := uploader(c)
+	if identity == "" {
+		c.Header("WWW-Authenticate", `Bearer realm="webshare"`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Listing uploads requires signing in or an API token."})
+		return
+	}
+	uploads, err := s.uploadsOf(identity)
+	if err != nil {
+		log.Error().Err(err).Str("user", identity).Msg("Error listing uploads")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list uploads"})
+		return
+	}
+	quota, err := s.quota(identity)
+	if err != nil {
+		log.Error().Err(err).Str("user", identity).Msg("Error loading quota")
+	}
+
+	items := make([]gin.H, 0, len(uploads))
+	for _, upload := range uploads {
+		s.countDownloads(upload)
+		item := gin.H{
+			"id":         path.Join(upload.ID, upload.Name),
+			"name":       upload.DisplayName,
+			"link":       upload.Link,
+			"size":       upload.Size,
+			"uploaded":   upload.Modified,
+			"expires_at": upload.ExpiresAt,
+			"downloads":  upload.Downloads,
+		}
+		if upload.MaxDownloads > 0 {
+			item["max_downloads"] = upload.MaxDownloads
+		}
+		items = append(items, item)
+	}
+	response := gin.H{"uploads": items, "used": usage(uploads)}
+	if quota > 0 {
+		response["quota"] = quota
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// countDownloads fills in the downloads of page.
+func (s *Server) countDownloads(page *Page) {
+	n, err := s.downloads.count(page)
+	if err != nil {
+		log.Error().Err(err).Str("id", page.ID).Msg("Error reading download counter")
+	}
+	page.Downloads = n
+}
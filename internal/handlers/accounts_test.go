@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tuilakhanh/webshare/internal/config"
+)
+
+func newAccountsTest(t *testing.T) *testServer {
+	t.Helper()
+	ts := newTestServer(t, func(cfg *config.Config) { cfg.Accounts = true })
+	if err := ts.server.CreateUser("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+// passwordLogin signs in with name and password and returns the response.
+func (ts *testServer) passwordLogin(t *testing.T, name string, password string) *http.Response {
+	t.Helper()
+	return ts.postForm(t, "/auth/password", url.Values{"username": {name}, "password": {password}})
+}
+
+// passwordLoginFrom signs in as if from the client at addr behind a proxy.
+func (ts *testServer) passwordLoginFrom(t *testing.T, addr string, name string, password string) *http.Response {
+	t.Helper()
+	form := url.Values{"username": {name}, "password": {password}}
+	req, err := http.NewRequest(http.MethodPost, ts.app.URL+"/auth/password", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Forwarded-For", addr)
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readResponse(t, resp)
+}
+
+func TestPasswordLogin(t *testing.T) {
+	ts := newAccountsTest(t)
+	if resp := ts.passwordLogin(t, "alice", "wrong"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong password: got %s, want %d", resp.Status, http.StatusUnauthorized)
+	}
+	if resp := ts.passwordLogin(t, "alice", "secret"); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("sign in: got %s, want %d", resp.Status, http.StatusSeeOther)
+	}
+	if !ts.signedIn(t) {
+		t.Error("the session is not accepted")
+	}
+}
+
+func TestPasswordLoginUnknownName(t *testing.T) {
+	ts := newAccountsTest(t)
+	known := ts.passwordLogin(t, "alice", "wrong")
+	unknown := ts.passwordLogin(t, "bob", "wrong")
+	if known.StatusCode != unknown.StatusCode || body(t, known) != body(t, unknown) {
+		t.Errorf("unknown names are rejected differently: got %s, want %s", unknown.Status, known.Status)
+	}
+}
+
+// Guessing the password of an account from one client must not lock out
+// the others.
+func TestPasswordLoginLimit(t *testing.T) {
+	ts := newAccountsTest(t)
+	for range maxPasswordAttempts {
+		if resp := ts.passwordLoginFrom(t, "192.0.2.1", "alice", "wrong"); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("wrong password: got %s, want %d", resp.Status, http.StatusUnauthorized)
+		}
+	}
+	if resp := ts.passwordLoginFrom(t, "192.0.2.1", "alice", "secret"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("after too many attempts: got %s, want %d", resp.Status, http.StatusTooManyRequests)
+	}
+	if resp := ts.passwordLoginFrom(t, "198.51.100.1", "alice", "secret"); resp.StatusCode != http.StatusSeeOther {
+		t.Errorf("from another client: got %s, want %d", resp.Status, http.StatusSeeOther)
+	}
+}
+
+func TestSetPasswordEndsSessions(t *testing.T) {
+	ts := newAccountsTest(t)
+	ts.passwordLogin(t, "alice", "secret")
+	if !ts.signedIn(t) {
+		t.Fatal("the session is not accepted")
+	}
+	if err := ts.server.SetQuota("alice", 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if !ts.signedIn(t) {
+		t.Error("changing the quota ended the session")
+	}
+	if err := ts.server.SetPassword("alice", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if ts.signedIn(t) {
+		t.Error("the session outlived the password change")
+	}
+	ts.passwordLogin(t, "alice", "changed")
+	if !ts.signedIn(t) {
+		t.Error("the session with the new password is not accepted")
+	}
+}
+
+func TestDeleteUserEndsSessions(t *testing.T) {
+	ts := newAccountsTest(t)
+	ts.passwordLogin(t, "alice", "secret")
+	if err := ts.server.DeleteUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if ts.signedIn(t) {
+		t.Error("the session outlived the account")
+	}
+}
+
+// tusCreate creates a resumable upload of length bytes with the API token
+// and returns its URL.
+func (ts *testServer) tusCreate(t *testing.T, token string, length int) string {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, ts.app.URL+"/files/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Upload-Length", strconv.Itoa(length))
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("creating upload: got %s, want %d", resp.Status, http.StatusCreated)
+	}
+	return ts.app.URL + resp.Header.Get("Location")
+}
+
+// tusPatch sends all of data to the upload at u and returns the status.
+func (ts *testServer) tusPatch(t *testing.T, token string, u string, data string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPatch, u, strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", "0")
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// Resumable uploads created while the quota had room for each of them
+// must not overshoot it together.
+func TestQuotaResumableUploads(t *testing.T) {
+	for _, indexed := range []bool{false, true} {
+		ts := newTestServer(t, func(cfg *config.Config) {
+			cfg.UserQuota = 100
+			if indexed {
+				cfg.IndexFile = filepath.Join(t.TempDir(), "index.db")
+			}
+		})
+		token, err := ts.server.CreateToken("ci")
+		if err != nil {
+			t.Fatal(err)
+		}
+		first := ts.tusCreate(t, token, 60)
+		second := ts.tusCreate(t, token, 60)
+		if status := ts.tusPatch(t, token, first, strings.Repeat("a", 60)); status != http.StatusNoContent {
+			t.Fatalf("indexed %v: finishing the first upload: got %d, want %d", indexed, status, http.StatusNoContent)
+		}
+		if status := ts.tusPatch(t, token, second, strings.Repeat("b", 60)); status != http.StatusRequestEntityTooLarge {
+			t.Errorf("indexed %v: finishing the second upload: got %d, want %d", indexed, status, http.StatusRequestEntityTooLarge)
+		}
+
+		id, _, _ := strings.Cut(token, ".")
+		used, err := ts.server.usageOf("token:" + id)
+		if err != nil || used != 60 {
+			t.Errorf("indexed %v: usage: got %d, %v, want 60", indexed, used, err)
+		}
+	}
+}
+
+// Form uploads sent at the same time must not overshoot the quota together
+// either, each holds back its size while it is stored.
+func TestQuotaConcurrentPosts(t *testing.T) {
+	ts := newTestServer(t, func(cfg *config.Config) { cfg.UserQuota = 500 })
+	token, err := ts.server.CreateToken("ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _, _ := strings.Cut(token, ".")
+	identity := "token:" + id
+	upload := func(content string) (body []byte, contentType string) {
+		buf := new(bytes.Buffer)
+		mw := multipart.NewWriter(buf)
+		fw, err := mw.CreateFormFile("file", "file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(content))
+		mw.Close()
+		return buf.Bytes(), mw.FormDataContentType()
+	}
+
+	// the first upload stalls halfway until the second one is answered
+	first, firstType := upload(strings.Repeat("a", 300))
+	pr, pw := io.Pipe()
+	// a failed test must not leave the server waiting for the rest
+	defer pw.Close()
+	req, err := http.NewRequest(http.MethodPost, ts.app.URL+"/", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = int64(len(first))
+	req.Header.Set("Content-Type", firstType)
+	req.Header.Set("Authorization", "Bearer "+token)
+	firstDone := make(chan int)
+	go func() {
+		resp, err := ts.client.Do(req)
+		if err != nil {
+			firstDone <- 0
+			return
+		}
+		resp.Body.Close()
+		firstDone <- resp.StatusCode
+	}()
+	pw.Write(first[:100])
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		ts.server.reservedMu.Lock()
+		reserved := ts.server.reserved[identity]
+		ts.server.reservedMu.Unlock()
+		if reserved > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			pw.CloseWithError(errors.New("aborted"))
+			<-firstDone
+			t.Fatal("the first upload reserved nothing")
+		}
+	}
+
+	second, secondType := upload(strings.Repeat("b", 300))
+	req2, err := http.NewRequest(http.MethodPost, ts.app.URL+"/", bytes.NewReader(second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req2.Header.Set("Content-Type", secondType)
+	req2.Header.Set("Authorization", "Bearer "+token)
+	resp, err := ts.client.Do(req2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("second upload: got %s, want %d", resp.Status, http.StatusBadRequest)
+	}
+
+	pw.Write(first[100:])
+	pw.Close()
+	if status := <-firstDone; status != http.StatusCreated {
+		t.Errorf("first upload: got %d, want %d", status, http.StatusCreated)
+	}
+	if used, err := ts.server.usageOf(identity); err != nil || used != 300 {
+		t.Errorf("usage: got %d, %v, want 300", used, err)
+	}
+}
@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	"github.com/tuilakhanh/webshare/internal/pkg"
+	"github.com/tuilakhanh/webshare/internal/storage"
+)
+
+// API tokens authenticate the clients that upload. They are created and
+// revoked with the admin commands and stored with the hash of their secret
+// only:
+//
+//	auth/tokens/<token id>.json.gz
+//
+// The token handed out is "<token id>.<secret>", so that it can be looked up
+// without comparing it to every stored hash.
+const authDir = "auth"
+
+func tokenKey(id string) string {
+	return path.Join(authDir, "tokens", id+".json.gz")
+}
+
+// APIToken is an API token as stored.
+type APIToken struct {
+	ID string
+	// Name tells whom the token was given to
+	Name string
+	// SecretHash is the hash of the secret part of the token
+	SecretHash string
+	Created    time.Time
+	// Revoked is when the token was revoked, zero while it is valid. Revoked
+	// tokens are kept so that the files uploaded with them can still be
+	// attributed.
+	Revoked time.Time
+}
+
+// Uploader returns the identity recorded in the files uploaded with t.
+func (t *APIToken) Uploader() string {
+	return "token:" + t.ID
+}
+
+var errInvalidToken = errors.New("invalid API token")
+
+// uploaderKey is the key of the gin context holding the identity of the
+// authenticated client.
+const uploaderKey = "uploader"
+
+// uploader returns the identity of the client that sent the request, empty
+// if it did not authenticate.
+func uploader(c *gin.Context) string {
+	return c.GetString(uploaderKey)
+}
+
+// authenticate checks the API token sent as "Authorization: Bearer <token>"
+// or the session of the web interface, and remembers whose it is. Requests
+// without either go on anonymously, requests with an invalid token are
+// rejected.
+func (s *Server) authenticate(c *gin.Context) {
+	header := c.GetHeader("Authorization")
+	if header == "" {
+		if identity := s.sessionIdentity(c); identity != "" {
+			c.Set(uploaderKey, identity)
+		}
+		return
+	}
+	scheme, token, _ := strings.Cut(header, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		c.Header("WWW-Authenticate", `Bearer realm="webshare"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Only bearer tokens are supported."})
+		return
+	}
+	t, err := loadValidToken(s.store, strings.TrimSpace(token))
+	if err != nil {
+		if !errors.Is(err, errInvalidToken) {
+			log.Error().Err(err).Msg("Error loading API token")
+		}
+		c.Header("WWW-Authenticate", `Bearer realm="webshare", error="invalid_token"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or revoked API token."})
+		return
+	}
+	c.Set(uploaderKey, t.Uploader())
+}
+
+// requireUploader rejects anonymous uploads if the server is configured to
+// only accept authenticated ones, which signing in to the web interface
+// implies. Downloads stay public either way.
+func (s *Server) requireUploader(c *gin.Context) {
+	if (!s.config.RequireAuth && s.oidc == nil) || uploader(c) != "" {
+		return
+	}
+	message := "Uploading requires an API token."
+	if s.signInEnabled() {
+		message = "Uploading requires signing in or an API token."
+	}
+	c.Header("WWW-Authenticate", `Bearer realm="webshare"`)
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": message})
+}
+
+// loadValidToken returns the stored token if token is one of ours and not
+// revoked.
+func loadValidToken(store storage.Storage, token string) (*APIToken, error) {
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok || id == "" {
+		return nil, errInvalidToken
+	}
+	if _, err := hex.DecodeString(id); err != nil {
+		return nil, errInvalidToken
+	}
+	t := new(APIToken)
+	if err := readGzippedJSON(t, tokenKey(id), store); errors.Is(err, storage.ErrNotExist) {
+		return nil, errInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+	if !pkg.SecretMatches(secret, t.SecretHash) || !t.Revoked.IsZero() {
+		return nil, errInvalidToken
+	}
+	return t, nil
+}
+
+// loadTokens returns all API tokens, the revoked ones included, oldest
+// first.
+func loadTokens(store storage.Storage) ([]*APIToken, error) {
+	names, err := store.List(path.Join(authDir, "tokens"))
+	if err != nil {
+		return nil, err
+	}
+	var tokens []*APIToken
+	for _, name := range names {
+		id, ok := strings.CutSuffix(name, ".json.gz")
+		if !ok {
+			continue
+		}
+		t := new(APIToken)
+		if err := readGzippedJSON(t, tokenKey(id), store); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Created.Before(tokens[j].Created) })
+	return tokens, nil
+}
+
+// CreateToken stores a new API token for name and returns it. Only its hash
+// is kept, the token can not be shown again.
+func (s *Server) CreateToken(name string) (token string, err error) {
+	b := make([]byte, 6)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	t := &APIToken{ID: hex.EncodeToString(b), Name: name, Created: time.Now()}
+	secret, hash, err := pkg.NewSecret()
+	if err != nil {
+		return
+	}
+	t.SecretHash = hash
+	if err = writeGzippedJSON(t, tokenKey(t.ID), s.store); err != nil {
+		return
+	}
+	return t.ID + "." + secret, nil
+}
+
+// RevokeToken revokes the API token with the given ID. The files uploaded
+// with it are kept.
+func (s *Server) RevokeToken(id string) error {
+	t := new(APIToken)
+	if err := readGzippedJSON(t, tokenKey(id), s.store); errors.Is(err, storage.ErrNotExist) {
+		return fmt.Errorf("no API token with ID %q", id)
+	} else if err != nil {
+		return err
+	}
+	if !t.Revoked.IsZero() {
+		return nil
+	}
+	t.Revoked = time.Now()
+	return writeGzippedJSON(t, tokenKey(id), s.store)
+}
+
+// PrintTokens writes the API tokens along with the files uploaded with
+// each of them.
+func (s *Server) PrintTokens(w io.Writer) error {
+	tokens, err := loadTokens(s.store)
+	if err != nil {
+		return err
+	}
+	uploads, err := s.allUploads()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tCREATED\tREVOKED\tFILES\tSIZE")
+	for _, t := range tokens {
+		revoked := "-"
+		if !t.Revoked.IsZero() {
+			revoked = t.Revoked.Local().Format(time.DateTime)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n",
+			t.ID, t.Name, t.Created.Local().Format(time.DateTime), revoked,
+			len(uploads[t.Uploader()]), humanize.Bytes(usage(uploads[t.Uploader()])))
+		for _, p := range uploads[t.Uploader()] {
+			fmt.Fprintf(tw, "\t  %s\t\t\t\t%s\n", path.Join(p.ID, p.Name), humanize.Bytes(p.Size))
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"errors"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/tuilakhanh/webshare/internal/config"
+	"github.com/tuilakhanh/webshare/internal/storage"
+)
+
+// blobsDir is where the data of the files is stored, once per content. Each
+// blob is named by the SHA-256 of the content and the codec it is stored
+// with, and holds the data along with an empty marker per ID that refers to
+// it:
+//
+//	blobs/<sha256>.<codec>/data
+//	blobs/<sha256>.<codec>/refs/<id>
+//
+// With encryption at rest the SHA-256 is replaced by a hash of it keyed with
+// the encryption keys, see blobName.
+const blobsDir = "blobs"
+
+// blobName returns the name of the blob for data with the given SHA-256,
+// stored with codec. If the storage is encrypted, the name is keyed with the
+// current master key, so that whoever can list the storage can not tell
+// whether it holds a known file. Uploads after the keys were rotated are not
+// deduplicated against the blobs stored before.
+func blobName(store storage.Storage, sum []byte, codec string) string {
+	if keys := storageKeys(store); keys != nil {
+		return keys.Name(sum) + "." + codec
+	}
+	return hex.EncodeToString(sum) + "." + codec
+}
+
+// storageKeys returns the keys store is encrypted with, nil if it is not.
+func storageKeys(store storage.Storage) *storage.Keyring {
+	for {
+		switch s := store.(type) {
+		case *storage.Encrypted:
+			return s.Keys()
+		case *Index:
+			store = s.Storage
+		default:
+			return nil
+		}
+	}
+}
+
+func blobKey(blob string) string {
+	return path.Join(blobsDir, blob, "data")
+}
+
+func blobRefsKey(blob string) string {
+	return path.Join(blobsDir, blob, "refs")
+}
+
+// isFileID reports whether the top level entry id of the storage is a file,
+// and not the blobs, the API tokens or a temporary file.
+func isFileID(id string) bool {
+	return id != blobsDir && id != authDir && !strings.HasPrefix(id, "upload_")
+}
+
+// blobLocks keep a blob from being deleted while a reference to it is
+// added. Each blob has a lock of its own, so that storing one upload does
+// not hold up the others.
+var (
+	blobLocksMu sync.Mutex
+	blobLocks   = make(map[string]*blobLock)
+)
+
+type blobLock struct {
+	sync.Mutex
+	// users counts who holds or waits for the lock, it is dropped when
+	// nobody does
+	users int
+}
+
+// lockBlob locks blob and returns the function that unlocks it.
+func lockBlob(blob string) (unlock func()) {
+	blobLocksMu.Lock()
+	l := blobLocks[blob]
+	if l == nil {
+		l = new(blobLock)
+		blobLocks[blob] = l
+	}
+	l.users++
+	blobLocksMu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		blobLocksMu.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(blobLocks, blob)
+		}
+		blobLocksMu.Unlock()
+	}
+}
+
+// storeBlob turns the data uploaded to key into a reference of id to blob.
+// The data is moved into place if the blob is new and dropped otherwise.
+func storeBlob(store storage.Storage, key string, blob string, id string) error {
+	defer lockBlob(blob)()
+	exists, err := storage.Exists(store, blobKey(blob))
+	if err != nil {
+		return err
+	}
+	if exists {
+		log.Debug().Str("id", id).Str("blob", blob).Msg("Upload is a duplicate")
+		err = store.Delete(key)
+	} else {
+		err = store.Move(key, blobKey(blob))
+	}
+	if err != nil {
+		return err
+	}
+	_, err = store.Put(path.Join(blobRefsKey(blob), id), strings.NewReader(""))
+	return err
+}
+
+// releaseBlob removes the reference of id to blob, and the blob along with
+// it if that was the last one.
+func releaseBlob(store storage.Storage, blob string, id string) error {
+	defer lockBlob(blob)()
+	err := store.Delete(path.Join(blobRefsKey(blob), id))
+	if err != nil && !errors.Is(err, storage.ErrNotExist) {
+		return err
+	}
+	return deleteUnreferenced(store, blob)
+}
+
+// deleteUnreferenced deletes blob if no ID refers to it anymore. The lock
+// of blob must be held.
+func deleteUnreferenced(store storage.Storage, blob string) error {
+	refs, err := store.List(blobRefsKey(blob))
+	if err != nil || len(refs) > 0 {
+		return err
+	}
+	log.Debug().Str("blob", blob).Msg("Deleting unreferenced blob")
+	err = store.Delete(path.Join(blobsDir, blob))
+	if errors.Is(err, storage.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// deleteFile deletes the file with the given ID and releases its blob.
+func deleteFile(store storage.Storage, config config.Config, id string) error {
+	page, err := loadPageInfo(id, config, store)
+	if err != nil {
+		// without meta information there is no blob to release
+		return store.Delete(id)
+	}
+	return deletePage(store, page)
+}
+
+// deletePage deletes the file of page and releases its blob.
+func deletePage(store storage.Storage, page *Page) error {
+	if err := store.Delete(page.ID); err != nil {
+		return err
+	}
+	if page.Blob != "" {
+		return releaseBlob(store, page.Blob, page.ID)
+	}
+	return nil
+}
+
+// collectBlobs drops the references of IDs that are gone, which happens if
+// a file is deleted behind the server's back, and the blobs left without one.
+func collectBlobs(store storage.Storage) {
+	blobs, err := store.List(blobsDir)
+	if err != nil {
+		log.Error().Err(err).Msg("Error listing blobs")
+		return
+	}
+	for _, blob := range blobs {
+		collectBlob(store, blob)
+	}
+}
+
+func collectBlob(store storage.Storage, blob string) {
+	defer lockBlob(blob)()
+	refs, err := store.List(blobRefsKey(blob))
+	if err != nil {
+		log.Error().Err(err).Str("blob", blob).Msg("Error listing blob references")
+		return
+	}
+	for _, id := range refs {
+		if _, pending := pendingIDs.Load(id); pending {
+			continue
+		}
+		if exists, err := storage.Exists(store, metaKey(id)); err != nil || exists {
+			continue
+		}
+		log.Warn().Str("blob", blob).Str("id", id).Msg("Dropping reference of missing file")
+		store.Delete(path.Join(blobRefsKey(blob), id))
+	}
+	if err := deleteUnreferenced(store, blob); err != nil {
+		log.Error().Err(err).Str("blob", blob).Msg("Error deleting blob")
+	}
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockBlob(t *testing.T) {
+	unlockA := lockBlob("a")
+	// other blobs do not wait
+	lockBlob("b")()
+
+	locked := make(chan func())
+	go func() { locked <- lockBlob("a") }()
+	select {
+	case <-locked:
+		t.Fatal("locked blob a twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlockA()
+	select {
+	case unlock := <-locked:
+		unlock()
+	case <-time.After(5 * time.Second):
+		t.Fatal("blob a stayed locked")
+	}
+
+	blobLocksMu.Lock()
+	defer blobLocksMu.Unlock()
+	if len(blobLocks) != 0 {
+		t.Errorf("%d locks left over, want none", len(blobLocks))
+	}
+}
+
+func TestBlobRefs(t *testing.T) {
+	ts := newTestServer(t, nil)
+	store := ts.server.store
+	blobRefs := func() map[string][]string {
+		t.Helper()
+		blobs, err := store.List(blobsDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs := make(map[string][]string)
+		for _, blob := range blobs {
+			if refs[blob], err = store.List(blobRefsKey(blob)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return refs
+	}
+	del := func(u uploaded) {
+		t.Helper()
+		id, _, _ := strings.Cut(u.ID, "/")
+		if resp := ts.request(t, http.MethodDelete, "/"+id, map[string]string{"X-Delete-Token": u.DeleteToken}); resp.StatusCode != http.StatusOK {
+			t.Fatalf("delete: got %s", resp.Status)
+		}
+	}
+
+	// the same content is stored once
+	first := ts.upload(t, nil, "shared content")
+	second := ts.upload(t, nil, "shared content")
+	other := ts.upload(t, nil, "other content")
+	refs := blobRefs()
+	if len(refs) != 2 {
+		t.Fatalf("got blobs %v, want 2", refs)
+	}
+
+	del(first)
+	if resp := ts.get(t, ts.app.URL+"/1/"+second.ID); resp.StatusCode != http.StatusOK || body(t, resp) != "shared content" {
+		t.Errorf("the copy is gone along with the first upload: %s", resp.Status)
+	}
+	if got := blobRefs(); len(got) != 2 {
+		t.Errorf("got blobs %v after deleting one reference, want both kept", got)
+	}
+
+	del(second)
+	got := blobRefs()
+	if len(got) != 1 {
+		t.Fatalf("got blobs %v after deleting the last reference, want only the other one", got)
+	}
+	otherID, _, _ := strings.Cut(other.ID, "/")
+	for _, ids := range got {
+		if len(ids) != 1 || ids[0] != otherID {
+			t.Errorf("got references %v, want %s", ids, otherID)
+		}
+	}
+
+	// a file deleted behind the back of the server drops its reference
+	if err := store.Delete(otherID); err != nil {
+		t.Fatal(err)
+	}
+	collectBlobs(store)
+	if got := blobRefs(); len(got) != 0 {
+		t.Errorf("got blobs %v after collecting them, want none", got)
+	}
+}
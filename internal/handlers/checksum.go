@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// errChecksumMismatch is returned when an upload does not have the checksum
+// the uploader expected, the data was corrupted on the way.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// parseChecksum parses a checksum of 32 bytes in hex, as SHA-256 and BLAKE3
+// checksums are written by sha256sum and b3sum.
+func parseChecksum(name string, value string) (string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if b, err := hex.DecodeString(value); err != nil || len(b) != 32 {
+		return "", fmt.Errorf("%s must be 64 hex digits", name)
+	}
+	return value, nil
+}
+
+// verify checks the checksums computed for page against the ones the
+// uploader expects.
+func (o *uploadOptions) verify(page *Page) error {
+	if o.SHA256 != "" && o.SHA256 != page.SHA256 {
+		return fmt.Errorf("%w: expected SHA-256 %s, got %s", errChecksumMismatch, o.SHA256, page.SHA256)
+	}
+	if o.BLAKE3 != "" && o.BLAKE3 != page.BLAKE3 {
+		return fmt.Errorf("%w: expected BLAKE3 %s, got %s", errChecksumMismatch, o.BLAKE3, page.BLAKE3)
+	}
+	return nil
+}
+
+// setDigestHeaders announces the SHA-256 of the data in the Repr-Digest
+// (RFC 9530) and the older Digest (RFC 3230) header. Both cover the data as
+// sent, so they are only set for responses without a Content-Encoding.
+func (p *Page) setDigestHeaders(w http.ResponseWriter) {
+	sum, err := hex.DecodeString(p.SHA256)
+	if err != nil || len(sum) == 0 {
+		return
+	}
+	b64 := base64.StdEncoding.EncodeToString(sum)
+	w.Header().Set("Repr-Digest", "sha-256=:"+b64+":")
+	w.Header().Set("Digest", "SHA-256="+b64)
+}
+
+// etag returns the entity tag of the data, without quotes.
+func (p *Page) etag() string {
+	if p.SHA256 != "" {
+		return p.SHA256
+	}
+	// files stored before SHA-256 was computed have an MD5
+	return p.Hash
+}
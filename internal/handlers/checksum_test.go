@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+
+	"lukechampine.com/blake3"
+
+	"github.com/tuilakhanh/webshare/internal/config"
+)
+
+func TestChecksums(t *testing.T) {
+	ts := newTestServer(t, func(cfg *config.Config) { cfg.BLAKE3 = true })
+	content := "checked content"
+	sum := sha256.Sum256([]byte(content))
+	b3 := blake3.Sum256([]byte(content))
+	sha, b3hex := hex.EncodeToString(sum[:]), hex.EncodeToString(b3[:])
+	wrong := strings.Repeat("0", 64)
+
+	for _, tt := range []struct {
+		name   string
+		fields map[string]string
+		status int
+	}{
+		{"none", nil, http.StatusCreated},
+		{"sha256", map[string]string{"sha256": sha}, http.StatusCreated},
+		{"upper case", map[string]string{"sha256": strings.ToUpper(sha)}, http.StatusCreated},
+		{"both", map[string]string{"sha256": sha, "blake3": b3hex}, http.StatusCreated},
+		{"wrong sha256", map[string]string{"sha256": wrong}, http.StatusBadRequest},
+		{"wrong blake3", map[string]string{"sha256": sha, "blake3": wrong}, http.StatusBadRequest},
+		{"not hex", map[string]string{"sha256": strings.Repeat("z", 64)}, http.StatusBadRequest},
+		{"too short", map[string]string{"sha256": sha[:62]}, http.StatusBadRequest},
+	} {
+		resp := ts.postUpload(t, tt.fields, content)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: got %s, want %d", tt.name, resp.Status, tt.status)
+		}
+	}
+
+	// the rejected uploads left nothing behind
+	ids, err := ts.server.store.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := 0
+	for _, id := range ids {
+		if isFileID(id) {
+			files++
+		}
+	}
+	if files != 4 {
+		t.Errorf("got %d files stored, want the 4 accepted ones", files)
+	}
+
+	u := ts.upload(t, map[string]string{"sha256": sha}, content)
+	if u.SHA256 != sha {
+		t.Errorf("upload: got SHA-256 %q, want %q", u.SHA256, sha)
+	}
+	resp := ts.request(t, http.MethodGet, "/1/"+u.ID, map[string]string{"Accept-Encoding": "identity"})
+	if got, want := resp.Header.Get("Repr-Digest"), "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":"; got != want {
+		t.Errorf("Repr-Digest: got %q, want %q", got, want)
+	}
+	if got := resp.Header.Get("ETag"); got != `"`+sha+`"` {
+		t.Errorf("ETag: got %q, want the SHA-256", got)
+	}
+}
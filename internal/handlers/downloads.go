@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/tuilakhanh/webshare/internal/storage"
+)
+
+// errNoDownloadsLeft is returned once all downloads of a limited share have
+// been handed out.
+var errNoDownloadsLeft = errors.New("no downloads left")
+
+// downloadsKey returns the storage key of the download counter for id. It
+// holds the number of downloads that are left.
+func downloadsKey(id string) string {
+	return path.Join(id, id+".downloads")
+}
+
+// downloadedKey returns the storage key of the number of times id was
+// downloaded, kept for shares without a download limit only.
+func downloadedKey(id string) string {
+	return path.Join(id, id+".downloaded")
+}
+
+// downloadCounter hands out the downloads of shares with a download limit.
+// A download is taken from the counter before it starts and given back if it
+// fails, the share is deleted once the last one has been sent completely.
+// The counter is atomic within one server only.
+//
+// The downloads of shares without a limit are only counted in memory and
+// written by flush, they are not worth a write to the storage each.
+type downloadCounter struct {
+	sync.Mutex
+	store storage.Storage
+	// inflight is the number of downloads in progress per ID
+	inflight map[string]int
+	// unflushed is the number of downloads of shares without a limit per
+	// ID that are not stored yet
+	unflushed map[string]int
+}
+
+func newDownloadCounter(store storage.Storage) *downloadCounter {
+	return &downloadCounter{store: store, inflight: make(map[string]int), unflushed: make(map[string]int)}
+}
+
+// remaining returns the number of downloads left for page.
+func (d *downloadCounter) remaining(page *Page) (int, error) {
+	d.Lock()
+	defer d.Unlock()
+	return d.read(page)
+}
+
+// take starts a download of page. finish must be called once it is done.
+func (d *downloadCounter) take(page *Page) error {
+	d.Lock()
+	defer d.Unlock()
+	remaining, err := d.read(page)
+	if err != nil {
+		return err
+	}
+	if remaining <= 0 {
+		return errNoDownloadsLeft
+	}
+	if err := d.write(page, remaining-1); err != nil {
+		return err
+	}
+	d.inflight[page.ID]++
+	return nil
+}
+
+// finish ends a download of page. A failed download is given back, the
+// share is deleted after the last download succeeded and no other one is
+// still in progress.
+func (d *downloadCounter) finish(page *Page, ok bool) {
+	d.Lock()
+	defer d.Unlock()
+	d.inflight[page.ID]--
+	remaining, err := d.read(page)
+	if err != nil {
+		log.Error().Err(err).Str("id", page.ID).Msg("Error reading download counter")
+		return
+	}
+	if !ok {
+		remaining++
+		if err := d.write(page, remaining); err != nil {
+			log.Error().Err(err).Str("id", page.ID).Msg("Error writing download counter")
+		}
+	}
+	if d.inflight[page.ID] > 0 {
+		return
+	}
+	delete(d.inflight, page.ID)
+	if remaining > 0 {
+		return
+	}
+	log.Info().Str("id", page.ID).Msg("Deleting file after its last download")
+	if err := deletePage(d.store, page); err != nil && !errors.Is(err, storage.ErrNotExist) {
+		log.Error().Err(err).Str("id", page.ID).Msg("Error deleting file")
+	}
+}
+
+// count returns how many times page was downloaded. Downloads of limited
+// shares that are still in progress are included.
+func (d *downloadCounter) count(page *Page) (int, error) {
+	d.Lock()
+	defer d.Unlock()
+	if page.MaxDownloads > 0 {
+		remaining, err := d.read(page)
+		return page.MaxDownloads - remaining, err
+	}
+	n, err := d.readDownloaded(page.ID)
+	return n + d.unflushed[page.ID], err
+}
+
+// downloaded records a download of a share without a download limit.
+func (d *downloadCounter) downloaded(page *Page) {
+	d.Lock()
+	defer d.Unlock()
+	d.unflushed[page.ID]++
+}
+
+// flush adds the downloads counted in memory to the stored counts. Those of
+// shares deleted in the meantime are dropped.
+func (d *downloadCounter) flush() {
+	d.Lock()
+	defer d.Unlock()
+	for id, n := range d.unflushed {
+		delete(d.unflushed, id)
+		if exists, err := storage.Exists(d.store, metaKey(id)); err != nil || !exists {
+			continue
+		}
+		stored, err := d.readDownloaded(id)
+		if err == nil {
+			_, err = d.store.Put(downloadedKey(id), strings.NewReader(strconv.Itoa(stored+n)))
+		}
+		if err != nil {
+			log.Error().Err(err).Str("id", id).Msg("Error writing download count")
+		}
+	}
+}
+
+func (d *downloadCounter) readDownloaded(id string) (int, error) {
+	f, err := d.store.Get(downloadedKey(id))
+	if errors.Is(err, storage.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// read returns the stored counter, a share without one has not been
+// downloaded yet.
+func (d *downloadCounter) read(page *Page) (int, error) {
+	f, err := d.store.Get(downloadsKey(page.ID))
+	if errors.Is(err, storage.ErrNotExist) {
+		return page.MaxDownloads, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+func (d *downloadCounter) write(page *Page, remaining int) error {
+	_, err := d.store.Put(downloadsKey(page.ID), strings.NewReader(strconv.Itoa(remaining)))
+	return err
+}
+
+// downloadWriter records whether a response was sent completely.
+type downloadWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+	failed  bool
+}
+
+func (w *downloadWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *downloadWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	if err != nil {
+		w.failed = true
+	}
+	return n, err
+}
+
+// complete reports whether the whole file was sent, comparing the body with
+// the Content-Length if there is one.
+func (w *downloadWriter) complete() bool {
+	if w.failed || w.status != http.StatusOK {
+		return false
+	}
+	if length := w.Header().Get("Content-Length"); length != "" {
+		return length == strconv.FormatInt(w.written, 10)
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tuilakhanh/webshare/internal/storage"
+)
+
+func TestDownloadCount(t *testing.T) {
+	store := storage.NewMemory()
+	page := &Page{ID: "abc", Name: "file.txt"}
+	if err := writeGzippedJSON(page, metaKey(page.ID), store); err != nil {
+		t.Fatal(err)
+	}
+	d := newDownloadCounter(store)
+
+	for range 3 {
+		d.downloaded(page)
+	}
+	if n, err := d.count(page); err != nil || n != 3 {
+		t.Errorf("count: got %d, %v, want 3", n, err)
+	}
+	if exists, _ := storage.Exists(store, downloadedKey(page.ID)); exists {
+		t.Error("downloads are written before they are flushed")
+	}
+
+	d.flush()
+	if n, err := newDownloadCounter(store).count(page); err != nil || n != 3 {
+		t.Errorf("count after flushing: got %d, %v, want 3", n, err)
+	}
+	d.downloaded(page)
+	if n, err := d.count(page); err != nil || n != 4 {
+		t.Errorf("count: got %d, %v, want 4", n, err)
+	}
+	d.flush()
+	if n, err := newDownloadCounter(store).count(page); err != nil || n != 4 {
+		t.Errorf("count after flushing again: got %d, %v, want 4", n, err)
+	}
+
+	// the count of a deleted share is not written back
+	d.downloaded(page)
+	if err := store.Delete(page.ID); err != nil {
+		t.Fatal(err)
+	}
+	d.flush()
+	if exists, _ := storage.Exists(store, downloadedKey(page.ID)); exists {
+		t.Error("the count of a deleted share was written")
+	}
+}
+
+func TestDownloadLimit(t *testing.T) {
+	ts := newTestServer(t, nil)
+	u := ts.upload(t, map[string]string{"max_downloads": "2"}, "twice")
+	id, _, _ := strings.Cut(u.ID, "/")
+	raw := "/1/" + u.ID
+	identity := map[string]string{"Accept-Encoding": "identity"}
+
+	// HEAD requests are free
+	resp := ts.request(t, http.MethodHead, raw, identity)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Webshare-Downloads-Remaining") != "2" {
+		t.Errorf("HEAD: got %s with %q downloads remaining, want 2", resp.Status, resp.Header.Get("Webshare-Downloads-Remaining"))
+	}
+	// ranges would let a download be split up, the whole file is sent
+	resp = ts.request(t, http.MethodGet, raw, map[string]string{"Accept-Encoding": "identity", "Range": "bytes=0-1"})
+	if resp.StatusCode != http.StatusOK || body(t, resp) != "twice" || resp.Header.Get("Cache-Control") != "no-store" {
+		t.Errorf("first download: got %s with Cache-Control %q", resp.Status, resp.Header.Get("Cache-Control"))
+	}
+	resp = ts.request(t, http.MethodHead, raw, identity)
+	if resp.Header.Get("Webshare-Downloads-Remaining") != "1" {
+		t.Errorf("HEAD: got %q downloads remaining, want 1", resp.Header.Get("Webshare-Downloads-Remaining"))
+	}
+	if resp := ts.request(t, http.MethodGet, raw, identity); resp.StatusCode != http.StatusOK || body(t, resp) != "twice" {
+		t.Errorf("last download: got %s", resp.Status)
+	}
+
+	// the file is deleted along with its blob after the last download, which
+	// may still be going on once the client has the whole file
+	store := ts.server.store
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		exists, err := storage.Exists(store, metaKey(id))
+		blobs, _ := store.List(blobsDir)
+		if err == nil && !exists && len(blobs) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("after the last download: got meta information %v, %v and blobs %v, want them gone", exists, err, blobs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if resp := ts.request(t, http.MethodGet, raw, identity); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("download after the last one: got %s, want %d", resp.Status, http.StatusNotFound)
+	}
+}
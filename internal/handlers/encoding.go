@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+
+	"github.com/tuilakhanh/webshare/internal/pkg"
+)
+
+// transcodeEncodings are the encodings compressed data can be recompressed
+// with on the fly, for clients that do not accept or do not prefer the
+// stored codec.
+var transcodeEncodings = []string{"gzip", "zstd", "br"}
+
+// negotiateEncoding returns the content coding from offers that the client
+// rates highest in its Accept-Encoding header, or "" if none is acceptable.
+// On a tie the earlier offer wins, so offers are listed cheapest first.
+// Clients that send no Accept-Encoding only get the identity coding.
+func negotiateEncoding(header string, offers []string) string {
+	qualities := make(map[string]float64)
+	for _, entry := range strings.Split(header, ",") {
+		params := strings.Split(entry, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		qualities[coding] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		q, ok := qualities[offer]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if !ok && offer == "identity" {
+			// identity is acceptable unless it is excluded explicitly, but
+			// any coding the client does list is preferred over it
+			q = 0.001
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// newEncoder compresses everything written to the returned writer with the
+// given content coding. Close must be called to flush it.
+func newEncoder(w io.Writer, encoding string) (io.WriteCloser, error) {
+	if encoding == "br" {
+		return brotli.NewWriterLevel(w, 5), nil
+	}
+	// the other codings are the codecs the uploads are stored with
+	return pkg.NewCodecWriter(w, encoding)
+}
+
+// notModified reports whether the cached copy of the client, described by
+// If-None-Match or If-Modified-Since, is still valid. It is only needed for
+// responses that are not served by http.ServeContent.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || (etag != "" && candidate == etag) {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modified.IsZero() {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(ims)
+}
+
+// writeNotModified answers with 304 the same way http.ServeContent does.
+func writeNotModified(w http.ResponseWriter) {
+	h := w.Header()
+	delete(h, "Content-Type")
+	delete(h, "Content-Length")
+	delete(h, "Content-Encoding")
+	if h.Get("Etag") != "" {
+		delete(h, "Last-Modified")
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	all := []string{"gzip", "identity", "zstd", "br"}
+	for _, tt := range []struct {
+		header string
+		offers []string
+		want   string
+	}{
+		{"", all, "identity"},
+		{"gzip", all, "gzip"},
+		{"GZIP", all, "gzip"},
+		{"br;q=0.5, zstd", all, "zstd"},
+		// a tie goes to the earlier offer
+		{"br, zstd, gzip", all, "gzip"},
+		{"*", all, "gzip"},
+		{"gzip;q=0", all, "identity"},
+		{"gzip;q=0.5, identity", all, "identity"},
+		{"gzip;q=0.5, identity;q=0.8", all, "identity"},
+		{"deflate", all, "identity"},
+		{"gzip;q=0", []string{"gzip"}, ""},
+		{"identity;q=0", []string{"identity"}, ""},
+		{"identity;q=0", []string{"gzip", "identity"}, ""},
+		{"gzip, identity;q=0", []string{"gzip", "identity"}, "gzip"},
+		{"*;q=0", []string{"identity"}, ""},
+		{"*;q=0, zstd", all, "zstd"},
+	} {
+		if got := negotiateEncoding(tt.header, tt.offers); got != tt.want {
+			t.Errorf("negotiateEncoding(%q, %v): got %q, want %q", tt.header, tt.offers, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadEncodings(t *testing.T) {
+	ts := newTestServer(t, nil)
+	content := strings.Repeat("compress me ", 1000)
+	raw := "/1/" + ts.upload(t, nil, content).ID
+
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		"": func(r io.Reader) (io.Reader, error) { return r, nil },
+		"gzip": func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		},
+		"zstd": func(r io.Reader) (io.Reader, error) {
+			return zstd.NewReader(r)
+		},
+		"br": func(r io.Reader) (io.Reader, error) {
+			return brotli.NewReader(r), nil
+		},
+	}
+	for _, tt := range []struct {
+		accept string
+		want   string
+	}{
+		// stored with gzip, which is sent as it is
+		{"gzip, zstd, br", "gzip"},
+		{"zstd", "zstd"},
+		{"br", "br"},
+		{"identity", ""},
+		{"gzip;q=0", ""},
+	} {
+		resp := ts.request(t, http.MethodGet, raw, map[string]string{"Accept-Encoding": tt.accept})
+		encoding := resp.Header.Get("Content-Encoding")
+		if resp.StatusCode != http.StatusOK || encoding != tt.want {
+			t.Errorf("%q: got %s encoded with %q, want %q", tt.accept, resp.Status, encoding, tt.want)
+			continue
+		}
+		r, err := decoders[encoding](resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := io.ReadAll(r); err != nil || string(got) != content {
+			t.Errorf("%q: decoded %d bytes, %v, want the %d uploaded", tt.accept, len(got), err, len(content))
+		}
+		if vary := resp.Header.Values("Vary"); !strings.Contains(strings.Join(vary, ","), "Accept-Encoding") {
+			t.Errorf("%q: got Vary %v, want Accept-Encoding", tt.accept, vary)
+		}
+	}
+
+	for _, accept := range []string{"identity;q=0", "*;q=0"} {
+		resp := ts.request(t, http.MethodGet, raw, map[string]string{"Accept-Encoding": accept})
+		if resp.StatusCode != http.StatusNotAcceptable {
+			t.Errorf("%q: got %s, want %d", accept, resp.Status, http.StatusNotAcceptable)
+		}
+	}
+}
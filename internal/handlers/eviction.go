@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/rs/zerolog/log"
+
+	"github.com/tuilakhanh/webshare/internal/config"
+	"github.com/tuilakhanh/webshare/internal/storage"
+)
+
+// evictionCandidate is a stored file that may be evicted to make room.
+type evictionCandidate struct {
+	page *Page
+	// size is the number of bytes stored for the file, counting its share
+	// of a blob that is shared with other files
+	size int64
+	// own is the number of bytes stored for the file apart from its blob
+	own int64
+	// lastAccess is the last download, or the upload if there was none
+	lastAccess time.Time
+}
+
+// EvictionPolicies order the files to evict when the storage exceeds
+// MaxBytesTotal, each returns whether a is evicted before b.
+var EvictionPolicies = map[string]func(a, b *evictionCandidate, now time.Time) bool{
+	"largest": func(a, b *evictionCandidate, now time.Time) bool {
+		return a.size > b.size
+	},
+	"oldest": func(a, b *evictionCandidate, now time.Time) bool {
+		return a.page.Modified.Before(b.page.Modified)
+	},
+	"lru": func(a, b *evictionCandidate, now time.Time) bool {
+		return a.lastAccess.Before(b.lastAccess)
+	},
+	"expiry": func(a, b *evictionCandidate, now time.Time) bool {
+		return a.page.ExpiresAt.Before(b.page.ExpiresAt)
+	},
+	// weighted evicts the files that free the most space for the least
+	// loss first: big files that were not downloaded for long and would
+	// expire soon anyway
+	"weighted": func(a, b *evictionCandidate, now time.Time) bool {
+		return a.weight(now) > b.weight(now)
+	},
+}
+
+func (e *evictionCandidate) weight(now time.Time) float64 {
+	idle := max(now.Sub(e.lastAccess).Hours(), 1)
+	left := max(e.page.ExpiresAt.Sub(now).Hours(), 1)
+	return float64(e.size) * idle / left
+}
+
+// trimMu keeps uploads finishing at the same time from evicting twice.
+var trimMu sync.Mutex
+
+// TrimContent evicts files according to the eviction policy until the
+// storage is below MaxBytesTotal. Every eviction leaves a tombstone behind.
+func TrimContent(config config.Config, store storage.Storage) {
+	trimMu.Lock()
+	defer trimMu.Unlock()
+
+	total, candidates, blobs, err := evictionCandidates(store, config)
+	if err != nil {
+		log.Error().Err(err).Msg("Error getting storage size")
+		return
+	}
+	if total < config.MaxBytesTotal {
+		return
+	}
+	log.Debug().
+		Int64("dir_size", total).
+		Int64("max_bytes_total", config.MaxBytesTotal).
+		Msg("Bytes in storage exceed maximum")
+
+	evictFirst := EvictionPolicies[config.Eviction]
+	now := time.Now()
+	sort.SliceStable(candidates, func(i, j int) bool { return evictFirst(candidates[i], candidates[j], now) })
+
+	reason := fmt.Sprintf("storage full (%s of %s), evicted by the %s policy",
+		humanize.Bytes(uint64(total)), humanize.Bytes(uint64(config.MaxBytesTotal)), config.Eviction)
+	for _, c := range candidates {
+		if total < config.MaxBytesTotal {
+			return
+		}
+		if err := deletePage(store, c.page); err != nil {
+			log.Error().Err(err).Str("id", c.page.ID).Msg("Error evicting file")
+			continue
+		}
+		// a blob only frees space along with its last reference
+		total -= c.own
+		if b, ok := blobs[c.page.Blob]; ok {
+			if b.refs--; b.refs == 0 {
+				total -= b.size
+			}
+		}
+		log.Info().
+			Str("id", c.page.ID).
+			Str("size", humanize.Bytes(uint64(c.size))).
+			Str("policy", config.Eviction).
+			Str("reason", reason).
+			Msg("Evicted file")
+		t := tombstone{ID: c.page.ID, Name: c.page.Name, Reason: reason, EvictedAt: now, ExpiresAt: c.page.ExpiresAt}
+		if err := writeGzippedJSON(t, tombstoneKey(c.page.ID), store); err != nil {
+			log.Error().Err(err).Str("id", c.page.ID).Msg("Error writing tombstone")
+		}
+	}
+	if total >= config.MaxBytesTotal {
+		log.Warn().Int64("dir_size", total).Msg("Storage still exceeds the limit, nothing left to evict")
+	}
+}
+
+// blobUsage is the size of a blob and the number of files referring to it.
+type blobUsage struct {
+	size int64
+	refs int
+}
+
+// evictionCandidates returns the size of the storage, the files in it and
+// the usage of the blobs. Files without meta information are uploads in
+// progress or tombstones, which are never evicted.
+func evictionCandidates(store storage.Storage, config config.Config) (total int64, candidates []*evictionCandidate, blobs map[string]*blobUsage, err error) {
+	sizes := make(map[string]int64)
+	accessed := make(map[string]time.Time)
+	blobs = make(map[string]*blobUsage)
+	err = store.Walk("", func(info storage.ObjectInfo) error {
+		total += info.Size
+		id, rest, _ := strings.Cut(info.Key, "/")
+		if id == blobsDir {
+			blob, kind, _ := strings.Cut(rest, "/")
+			if blobs[blob] == nil {
+				blobs[blob] = new(blobUsage)
+			}
+			if kind == "data" {
+				blobs[blob].size += info.Size
+			} else {
+				blobs[blob].refs++
+			}
+			return nil
+		}
+		sizes[id] += info.Size
+		if info.Key == accessKey(id) {
+			accessed[id] = info.ModTime
+		}
+		return nil
+	})
+	if err != nil || total < config.MaxBytesTotal {
+		return
+	}
+	for id, own := range sizes {
+		page, err := loadPageInfo(id, config, store)
+		if err != nil {
+			continue
+		}
+		size := own
+		if b, ok := blobs[page.Blob]; ok && b.refs > 0 {
+			size += b.size / int64(b.refs)
+		}
+		c := &evictionCandidate{page: page, size: size, own: own, lastAccess: page.Modified}
+		if t, ok := accessed[id]; ok && t.After(c.lastAccess) {
+			c.lastAccess = t
+		}
+		candidates = append(candidates, c)
+	}
+	return
+}
+
+// accessKey returns the storage key of the marker whose modification time is
+// the last download of id.
+func accessKey(id string) string {
+	return path.Join(id, id+".accessed")
+}
+
+// accessInterval is how often the access marker of a file is renewed at most.
+const accessInterval = time.Hour
+
+// accessWrites holds when the access marker of each ID was last renewed.
+var accessWrites sync.Map
+
+// recordAccess notes that id was downloaded, for the lru and weighted
+// eviction policies.
+func recordAccess(store storage.Storage, id string) {
+	now := time.Now()
+	if last, ok := accessWrites.Load(id); ok && now.Sub(last.(time.Time)) < accessInterval {
+		return
+	}
+	accessWrites.Store(id, now)
+	if _, err := store.Put(accessKey(id), strings.NewReader("")); err != nil {
+		log.Warn().Err(err).Str("id", id).Msg("Error recording download")
+	}
+}
+
+// tombstone is left behind when a file is evicted, to tell visitors what
+// happened to it. It is deleted when the file would have expired.
+type tombstone struct {
+	ID        string
+	Name      string
+	Reason    string
+	EvictedAt time.Time
+	ExpiresAt time.Time
+}
+
+func tombstoneKey(id string) string {
+	return path.Join(id, id+".tombstone.json.gz")
+}
+
+// loadTombstone returns the tombstone of id, storage.ErrNotExist if there
+// is none.
+func loadTombstone(id string, store storage.Storage) (*tombstone, error) {
+	t := new(tombstone)
+	if err := readGzippedJSON(t, tombstoneKey(id), store); err != nil {
+		if !errors.Is(err, storage.ErrNotExist) {
+			log.Error().Err(err).Str("id", id).Msg("Error reading tombstone")
+		}
+		return nil, err
+	}
+	return t, nil
+}
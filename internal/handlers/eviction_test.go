@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tuilakhanh/webshare/internal/config"
+	"github.com/tuilakhanh/webshare/internal/storage"
+)
+
+func TestEvictionPolicies(t *testing.T) {
+	now := time.Now()
+	candidate := func(id string, size int64, modified, accessed, expires time.Duration) *evictionCandidate {
+		page := &Page{ID: id, Modified: now.Add(modified), ExpiresAt: now.Add(expires)}
+		return &evictionCandidate{page: page, size: size, lastAccess: now.Add(accessed)}
+	}
+	candidates := []*evictionCandidate{
+		candidate("big", 300, -3*time.Hour, -time.Hour, 10*time.Hour),
+		candidate("old", 100, -10*time.Hour, -2*time.Hour, 20*time.Hour),
+		candidate("idle", 100, -5*time.Hour, -30*time.Hour, 10*time.Hour),
+		candidate("expiring", 100, -4*time.Hour, -time.Hour, time.Hour),
+		// 250 bytes idle for 12 hours with 2 hours left
+		candidate("heavy", 250, -2*time.Hour, -12*time.Hour, 2*time.Hour),
+	}
+	for policy, want := range map[string]string{
+		"largest":  "big",
+		"oldest":   "old",
+		"lru":      "idle",
+		"expiry":   "expiring",
+		"weighted": "heavy",
+	} {
+		evictFirst, ok := EvictionPolicies[policy]
+		if !ok {
+			t.Fatalf("no %s policy", policy)
+		}
+		sorted := append([]*evictionCandidate(nil), candidates...)
+		sort.SliceStable(sorted, func(i, j int) bool { return evictFirst(sorted[i], sorted[j], now) })
+		if got := sorted[0].page.ID; got != want {
+			t.Errorf("%s: evicts %s first, want %s", policy, got, want)
+		}
+	}
+}
+
+func TestTrimContent(t *testing.T) {
+	store := storage.NewMemory()
+	now := time.Now()
+	for i, id := range []string{"a", "b", "c"} {
+		page := &Page{ID: id, Name: id + ".txt", Modified: now.Add(time.Duration(i) * time.Hour), ExpiresAt: now.Add(24 * time.Hour)}
+		if err := writeGzippedJSON(page, metaKey(id), store); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Put(id+"/"+id+".txt", strings.NewReader(strings.Repeat(id, 1000))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	total, _, _, err := evictionCandidates(store, config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one file has to go to get below the limit, the oldest one
+	cfg := config.Config{MaxBytesTotal: total - 500, Eviction: "oldest"}
+	TrimContent(cfg, store)
+	for id, want := range map[string]bool{"a": false, "b": true, "c": true} {
+		if exists, err := storage.Exists(store, metaKey(id)); err != nil || exists != want {
+			t.Errorf("%s: got %v, %v, want it stored %v", id, exists, err, want)
+		}
+	}
+	tomb, err := loadTombstone("a", store)
+	if err != nil || tomb.Name != "a.txt" || !strings.Contains(tomb.Reason, "oldest") {
+		t.Errorf("tombstone: got %+v, %v", tomb, err)
+	}
+
+	// nothing is evicted below the limit
+	TrimContent(cfg, store)
+	if exists, _ := storage.Exists(store, metaKey("b")); !exists {
+		t.Error("evicted a file below the limit")
+	}
+}
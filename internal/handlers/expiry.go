@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"errors"
+	"time"
+
+	"github.com/tuilakhanh/webshare/internal/config"
+	"github.com/tuilakhanh/webshare/internal/pkg"
+)
+
+// parseExpiry parses the expiry chosen by an uploader, either a duration like
+// "90m", "1h" or "7d", or an absolute RFC 3339 timestamp.
+func parseExpiry(value string) (expiry time.Duration, expiresAt time.Time, err error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		if !t.After(time.Now()) {
+			return 0, time.Time{}, errors.New("expires must be in the future")
+		}
+		return 0, t, nil
+	}
+	expiry, err = pkg.ParseDuration(value)
+	if err != nil || expiry <= 0 {
+		return 0, time.Time{}, errors.New("expires must be a duration like 1h or 7d, or an RFC 3339 timestamp")
+	}
+	return expiry, time.Time{}, nil
+}
+
+// expiresAt returns when the upload of page expires: at the time the
+// uploader chose, but never later than the retention policy allows.
+func expiresAt(opts uploadOptions, config config.Config, page *Page) (time.Time, error) {
+	policy, err := pkg.NewRetentionPolicy(config)
+	if err != nil {
+		return time.Time{}, err
+	}
+	latest := page.Modified.Add(policy.Lifetime(page.ContentType, page.Size))
+	chosen := opts.ExpiresAt
+	if opts.Expiry > 0 {
+		chosen = page.Modified.Add(opts.Expiry)
+	}
+	if chosen.IsZero() || chosen.After(latest) {
+		return latest, nil
+	}
+	return chosen, nil
+}
@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadExpiry(t *testing.T) {
+	ts := newTestServer(t, nil)
+	// small files are kept for the whole MaxRetention of the test server
+	latest := time.Now().Add(24 * time.Hour)
+	for _, tt := range []struct {
+		expires string
+		want    time.Time
+	}{
+		{"", latest},
+		{"1h", time.Now().Add(time.Hour)},
+		{"90m", time.Now().Add(90 * time.Minute)},
+		{time.Now().Add(2 * time.Hour).UTC().Format(time.RFC3339), time.Now().Add(2 * time.Hour)},
+		// later than the server allows
+		{"7d", latest},
+		{"106751d", latest},
+		{time.Now().AddDate(1, 0, 0).Format(time.RFC3339), latest},
+	} {
+		u := ts.upload(t, map[string]string{"expires": tt.expires}, "expiring")
+		id, _, _ := strings.Cut(u.ID, "/")
+		page, err := loadPageInfo(id, *ts.server.config, ts.server.store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.ExpiresAt.Sub(tt.want).Abs() > time.Minute {
+			t.Errorf("expires %q: expires at %v, want %v", tt.expires, page.ExpiresAt, tt.want)
+		}
+	}
+
+	for _, expires := range []string{"0h", "-1h", "-1d", "106752d", "soon", time.Now().Add(-time.Hour).Format(time.RFC3339)} {
+		if resp := ts.postUpload(t, map[string]string{"expires": expires}, "expiring"); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expires %q: got %s, want %d", expires, resp.Status, http.StatusBadRequest)
+		}
+	}
+}
@@ -1,144 +1,293 @@
 package handlers
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
-	"fmt"
-	"os"
+	"errors"
+	"hash"
+	"io"
 	"path"
-	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/rs/zerolog/log"
+	"lukechampine.com/blake3"
 
+	"github.com/tuilakhanh/webshare/client"
 	"github.com/tuilakhanh/webshare/internal/config"
 	"github.com/tuilakhanh/webshare/internal/pkg"
+	"github.com/tuilakhanh/webshare/internal/storage"
 )
 
-// TrimContent will continually purge things from the content directory until
-// the content directoyr is below the specified size
-func TrimContent(config config.Config) {
-	for i := 0; i < 30; i++ {
-		dirSize, biggestFileID, err := DirSize(config.ContentDirectory)
-		if err != nil {
-			log.Error().Err(err).Msg("Error getting directory size")
-		}
-		if dirSize < config.MaxBytesTotal || biggestFileID == "" {
-			break
-		}
-		log.Debug().
-			Int64("dir_size", dirSize).
-			Int64("max_bytes_total", config.MaxBytesTotal).
-			Msg("Bytes in directory exceeds max")
-		log.Debug().
-			Str("biggest_file_id", biggestFileID).
-			Msg("Removing file")
-		os.RemoveAll(path.Join(config.ContentDirectory, biggestFileID))
-	}
-	log.Warn().Msg("TrimContent reached maximum iterations. Directory may still exceed limit.")
+// uploadOptions are the choices of the uploader that are stored with the file.
+type uploadOptions struct {
+	// PasswordHash is the hash of the password protecting the file
+	PasswordHash string
+	// MaxDownloads is the number of downloads after which the file is
+	// deleted, 0 means unlimited
+	MaxDownloads int
+	// Expiry or ExpiresAt is when the uploader wants the file deleted,
+	// capped by the maximum lifetime for its size
+	Expiry    time.Duration
+	ExpiresAt time.Time
+	// SHA256 and BLAKE3 are the checksums the uploader expects, an upload
+	// with different ones is rejected
+	SHA256 string
+	BLAKE3 string
+	// Encrypted is set if the data was encrypted end-to-end by the client,
+	// EncryptedMeta holds the name and type of the file sealed by it
+	Encrypted     bool
+	EncryptedMeta string
+	// Uploader is the identity of the authenticated client, it is never
+	// taken from the uploaded fields
+	Uploader string
 }
 
-// DirSize returns the size of a directory in bytes and biggestFileID
-func DirSize(path string) (int64, string, error) {
-	var size int64
-	biggestFileID := ""
-	biggestFileSize := int64(0)
-	err := filepath.Walk(path, func(pathName string, info os.FileInfo, err error) error {
+// errNotEncrypted is returned for uploads that are meant to be encrypted
+// end-to-end but are not in the format of the client.
+var errNotEncrypted = errors.New("upload is not end-to-end encrypted")
+
+// set parses the upload option named key, as sent in a form field or in the
+// tus metadata. Unknown keys are ignored, empty values keep the default.
+func (o *uploadOptions) set(key string, value string) (err error) {
+	if value == "" {
+		return nil
+	}
+	switch key {
+	case "password":
+		o.PasswordHash, err = hashPassword(value)
+	case "max_downloads":
+		o.MaxDownloads, err = strconv.Atoi(value)
+		if err != nil || o.MaxDownloads < 0 {
+			return errors.New("max_downloads must be a positive number")
+		}
+	case "expires":
+		o.Expiry, o.ExpiresAt, err = parseExpiry(value)
+	case "sha256":
+		o.SHA256, err = parseChecksum(key, value)
+	case "blake3":
+		o.BLAKE3, err = parseChecksum(key, value)
+	case "e2e":
+		o.Encrypted, err = strconv.ParseBool(value)
 		if err != nil {
-			return err
+			return errors.New("e2e must be true or false")
 		}
-		if !info.IsDir() {
-			size += info.Size()
-			if info.Size() > biggestFileSize {
-				pathName = filepath.ToSlash(pathName)
-				biggestFileID = strings.Split(pathName, "/")[1]
-				biggestFileSize = info.Size()
-			}
+	case "e2e_meta":
+		if _, err := base64.RawURLEncoding.DecodeString(value); err != nil {
+			return errors.New("e2e_meta must be unpadded base64url")
 		}
-		return err
-	})
-	return size, biggestFileID, err
+		o.EncryptedMeta = value
+	}
+	return err
 }
 
-// copyToContentDirectory will move the temp file to the content directory and calculate
-// the hash for generating the ID. It will also save the meta information in the content
-// directory (the .json.gz files).
-func copyToContentDirectory(fname string, tempFname string, originalSize uint64, config config.Config) (fnameFull string, err error) {
-	defer os.Remove(tempFname)
+// copyToContentDirectory streams the upload read from r into the storage
+// under a new random ID and returns its page. The name sent by the client is
+// sanitized first. It compresses the data according to the compression
+// policy, calculates its checksums and sniffs its content type in a single
+// pass. It will also save the meta information in the storage (the .json.gz
+// files). The returned delete token is only stored as a hash, so it must be
+// handed to the uploader right away.
+func copyToContentDirectory(fname string, r io.Reader, opts uploadOptions, config config.Config, store storage.Storage) (page *Page, deleteToken string, err error) {
+	display, fname, err := pkg.SanitizeFilename(fname)
+	if err != nil {
+		log.Debug().Err(err).Str("filename", fname).Msg("Rejecting upload")
+		return nil, "", err
+	}
+
 	defer func() {
-		go TrimContent(config)
+		go TrimContent(config, store)
 	}()
 
-	hash, _ := pkg.FileMD5(tempFname)
+	id, release, err := reserveID(config, store)
+	if err != nil {
+		log.Error().Err(err).Msg("Error generating ID")
+		return nil, "", err
+	}
+	defer release()
 
-	id := pkg.RandomName(hash)
+	// peek at the beginning of the data to sniff the content type and to
+	// decide how to compress it
+	br := bufio.NewReaderSize(r, pkg.SampleLen)
+	sample, err := br.Peek(pkg.SampleLen)
+	if err != nil && err != io.EOF {
+		log.Error().Err(err).Msg("Error reading upload")
+		return nil, "", err
+	}
+	header := sample[:min(len(sample), pkg.SniffLen)]
 
-	destDir := path.Join(config.ContentDirectory, id)
-	if _, err := os.Stat(destDir); !os.IsNotExist(err) {
-		err = os.RemoveAll(destDir)
-		if err != nil {
-			log.Error().Err(err).Msg("Error removing existing directory")
-			return "", err
+	page = NewPage(config, store)
+	page.ID = id
+	page.Name = fname
+	page.DisplayName = display
+	page.Modified = time.Now()
+	page.ModifiedHuman = humanize.Time(page.Modified)
+	if opts.Encrypted {
+		// the data is opaque, there is nothing to sniff or compress
+		if !client.IsEncrypted(sample) {
+			return nil, "", errNotEncrypted
 		}
+		page.Encrypted = true
+		page.EncryptedMeta = opts.EncryptedMeta
+		page.ContentType = "application/octet-stream"
+		page.Codec = pkg.CodecIdentity
+	} else {
+		page.ContentType, page.IsASCII = pkg.DetectContentType(fname, header)
+		page.IsImage = strings.Contains(page.ContentType, "image/")
+		page.IsText = strings.Contains(page.ContentType, "text/")
+		page.IsAudio = strings.Contains(page.ContentType, "audio/")
+		page.IsVideo = strings.Contains(page.ContentType, "video/")
+		page.Codec = pkg.ChooseCodec(config, page.ContentType, sample)
 	}
+	page.PasswordHash = opts.PasswordHash
+	page.MaxDownloads = opts.MaxDownloads
+	page.Uploader = opts.Uploader
+	page.Link = rawLink(config, page)
+	log.Debug().Str("content_type", page.ContentType).Str("codec", page.Codec).Msg("Chose codec")
 
-	if err := os.MkdirAll(destDir, os.ModePerm); err != nil {
-		log.Error().Err(err).Msg("Error creating directory")
-		return "", err
+	// encode and hash the original data on the way into the storage, the
+	// data is moved to its blob once the SHA-256 is known
+	sum := sha256.New()
+	var b3 hash.Hash
+	if config.BLAKE3 || opts.BLAKE3 != "" {
+		b3 = blake3.New(32, nil)
 	}
+	pr, pw := io.Pipe()
+	copied := make(chan int64, 1)
+	go func() {
+		encoder, err := pkg.NewCodecWriter(pw, page.Codec)
+		var n int64
+		if err == nil {
+			writers := []io.Writer{encoder, sum}
+			if b3 != nil {
+				writers = append(writers, b3)
+			}
+			n, err = io.Copy(io.MultiWriter(writers...), br)
+		}
+		if err == nil {
+			err = encoder.Close()
+		}
+		pw.CloseWithError(err)
+		copied <- n
+	}()
 
-	err = os.Rename(tempFname, path.Join(config.ContentDirectory, id, fname))
+	page.NameOnDisk = path.Join(id, fname)
+	_, err = store.Put(page.NameOnDisk, pr)
+	pr.CloseWithError(err)
+	originalSize := <-copied
 	if err != nil {
-		log.Error().Err(err).Msg("Error renaming file")
-		return
+		log.Error().Err(err).Msg("Error storing file")
+		return nil, "", err
 	}
 
-	log.Debug().Msgf("Moved to %s", fnameFull)
+	page.SHA256 = hex.EncodeToString(sum.Sum(nil))
+	blob := blobName(store, sum.Sum(nil), page.Codec)
+	if b3 != nil {
+		page.BLAKE3 = hex.EncodeToString(b3.Sum(nil))
+	}
+	if err := opts.verify(page); err != nil {
+		log.Warn().Err(err).Str("id", id).Msg("Rejecting upload")
+		store.Delete(id)
+		return nil, "", err
+	}
 
-	fnameFull = path.Join(id, fname)
+	if err := storeBlob(store, page.NameOnDisk, blob, id); err != nil {
+		log.Error().Err(err).Msg("Error storing blob")
+		store.Delete(id)
+		return nil, "", err
+	}
+	page.Blob = blob
+	page.NameOnDisk = blobKey(blob)
+	log.Debug().Msgf("Stored %s", page.NameOnDisk)
 
-	page := NewPage(config)
-	page.ID = id
-	page.Hash = hash
-	page.Name = fname
-	page.Size = originalSize
-	page.SizeHuman = humanize.Bytes(originalSize)
-	page.Modified = time.Now()
-	page.ModifiedHuman = humanize.Time(page.Modified)
-	page.Link = fmt.Sprintf("/1/%s/%s", page.ID, page.Name)
-	var isASCIIIData bool
-	page.ContentType, isASCIIIData, err = pkg.GetFileContentType(path.Join(config.ContentDirectory, page.ID, page.Name))
+	page.Size = uint64(originalSize)
+	page.SizeHuman = humanize.Bytes(page.Size)
+	page.ExpiresAt, err = expiresAt(opts, config, page)
+	if err == nil {
+		deleteToken, page.DeleteTokenHash, err = pkg.NewSecret()
+	}
 	if err != nil {
-		log.Error().Err(err).Msg("Error getting content type")
-		return
+		log.Error().Err(err).Msg("Error generating expiry or delete token")
+		deleteUpload(store, id, blob)
+		return nil, "", err
 	}
-	page.IsImage = strings.Contains(page.ContentType, "image/")
-	page.IsText = strings.Contains(page.ContentType, "text/")
-	page.IsAudio = strings.Contains(page.ContentType, "audio/")
-	page.IsVideo = strings.Contains(page.ContentType, "video/")
-	page.IsASCII = isASCIIIData
 
-	metaFilePath := path.Join(destDir, id+".json.gz")
-	if err := writeGzippedJSON(page, metaFilePath); err != nil {
+	if err := writeGzippedJSON(page, metaKey(id), store); err != nil {
 		log.Error().Err(err).Msg("Error writing JSON metadata")
-		return "", err
+		deleteUpload(store, id, blob)
+		return nil, "", err
 	}
 
 	return
 }
 
-// writeGzippedJSON writes the given data as gzipped JSON to the specified file path.
-func writeGzippedJSON(data interface{}, filePath string) error {
-	file, err := os.Create(filePath)
+// deleteUpload removes an upload that failed after its blob was stored.
+func deleteUpload(store storage.Storage, id string, blob string) {
+	store.Delete(id)
+	if err := releaseBlob(store, blob, id); err != nil {
+		log.Error().Err(err).Str("blob", blob).Msg("Error releasing blob")
+	}
+}
+
+// maxIDAttempts is how many random IDs are tried before giving up on an upload.
+const maxIDAttempts = 10
+
+// pendingIDs holds the IDs handed out to uploads that are not stored yet, so
+// that two concurrent uploads can never end up with the same ID.
+var pendingIDs sync.Map
+
+// reserveID returns a random ID that is neither in the storage nor used by
+// another upload in progress. The caller must call release once the upload
+// is stored (or has failed). IDs of the old 3 digit scheme stay valid, they
+// are simply never handed out again while they exist.
+func reserveID(config config.Config, store storage.Storage) (id string, release func(), err error) {
+	gen, err := pkg.NewIDGenerator(config)
 	if err != nil {
-		return err
+		return
+	}
+	for i := 0; i < maxIDAttempts; i++ {
+		id, err = gen.New()
+		if err != nil {
+			return
+		}
+		if _, taken := pendingIDs.LoadOrStore(id, true); taken {
+			log.Warn().Str("id", id).Msg("ID collision with upload in progress, retrying")
+			continue
+		}
+		var existing []string
+		existing, err = store.List(id)
+		if err != nil {
+			pendingIDs.Delete(id)
+			return
+		}
+		if len(existing) > 0 {
+			pendingIDs.Delete(id)
+			log.Warn().Str("id", id).Msg("ID collision with stored file, retrying")
+			continue
+		}
+		reserved := id
+		return id, func() { pendingIDs.Delete(reserved) }, nil
 	}
-	defer file.Close()
+	return "", nil, errors.New("could not find a free ID, consider a longer id-length")
+}
+
+// metaKey returns the storage key of the meta information for id.
+func metaKey(id string) string {
+	return path.Join(id, id+".json.gz")
+}
 
-	gzWriter := gzip.NewWriter(file)
-	defer gzWriter.Close()
+// writeGzippedJSON writes the given data as gzipped JSON under the specified key.
+func writeGzippedJSON(data interface{}, key string, store storage.Storage) error {
+	buf := new(bytes.Buffer)
+	gzWriter := gzip.NewWriter(buf)
 
 	encoder := json.NewEncoder(gzWriter)
 	encoder.SetIndent("", " ") // Optional: for pretty-printing
@@ -146,6 +295,27 @@ func writeGzippedJSON(data interface{}, filePath string) error {
 	if err := encoder.Encode(data); err != nil {
 		return err
 	}
+	if err := gzWriter.Close(); err != nil {
+		return err
+	}
+
+	_, err := store.Put(key, buf)
+	return err
+}
+
+// readGzippedJSON decodes the gzipped JSON stored under the specified key into data.
+func readGzippedJSON(data interface{}, key string, store storage.Storage) error {
+	f, err := store.Get(key)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gzReader, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gzReader.Close()
 
-	return gzWriter.Flush()
+	return json.NewDecoder(gzReader).Decode(data)
 }
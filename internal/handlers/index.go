@@ -0,0 +1,573 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/tuilakhanh/webshare/internal/storage"
+)
+
+var (
+	// objectsBucket maps the key of every stored object to its indexEntry
+	objectsBucket = []byte("objects")
+	// metaBucket maps every ID to its meta information as JSON, sealed with
+	// the encryption keys if the storage is encrypted
+	metaBucket = []byte("meta")
+	// settingsBucket holds how the index was built
+	settingsBucket = []byte("settings")
+	// sealedWithKey is the setting holding the ID of the master key the meta
+	// information is sealed with, empty if it is plain
+	sealedWithKey = []byte("sealed-with")
+)
+
+// indexEntry is what the index knows about a stored object.
+type indexEntry struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// Index keeps the listing of a storage and the meta information of every
+// file in an embedded database, so that lookups, listings and size checks
+// do not have to read the storage. It wraps the storage: every Put and
+// Delete goes through it and updates the database along the way. Which
+// files every uploader stores is kept in memory for the storage quotas.
+//
+// The API tokens and accounts below auth/ are left out and always read from
+// the storage, the admin commands change them while a server holds the
+// index.
+//
+// With encryption at rest, keys are the keys of the storage and the meta
+// information is sealed with them, so that the database tells no more than
+// the storage does.
+type Index struct {
+	storage.Storage
+	db   *bolt.DB
+	keys *storage.Keyring
+
+	mu sync.Mutex
+	// uploaderOf maps the ID of every file that has an uploader to it
+	uploaderOf map[string]string
+	// uploads maps every uploader to the sizes of its files by ID
+	uploads map[string]map[string]uint64
+}
+
+// OpenIndex opens the index database at file for store, whose objects are
+// encrypted with keys if keys is not nil. The index is built from the
+// storage right away if it is new, or if it was sealed with another key.
+func OpenIndex(file string, store storage.Storage, keys *storage.Keyring) (*Index, error) {
+	db, err := bolt.Open(file, 0o600, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("index %s is in use by another process", file)
+	} else if err != nil {
+		return nil, err
+	}
+	idx := &Index{
+		Storage:    store,
+		db:         db,
+		keys:       keys,
+		uploaderOf: make(map[string]string),
+		uploads:    make(map[string]map[string]uint64),
+	}
+	var empty, resealed bool
+	err = db.View(func(tx *bolt.Tx) error {
+		empty = tx.Bucket(objectsBucket) == nil
+		if settings := tx.Bucket(settingsBucket); !empty {
+			var sealedWith []byte
+			if settings != nil {
+				sealedWith = settings.Get(sealedWithKey)
+			}
+			resealed = string(sealedWith) != idx.keyID()
+		}
+		return nil
+	})
+	if err == nil && (empty || resealed) {
+		log.Info().Str("index", file).Bool("new_key", resealed).Msg("Building index")
+		err = idx.Rebuild()
+	} else if err == nil {
+		err = idx.loadUploads()
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return idx, nil
+}
+
+// keyID returns the ID of the key the meta information is sealed with.
+func (idx *Index) keyID() string {
+	if idx.keys == nil {
+		return ""
+	}
+	return idx.keys.CurrentID()
+}
+
+// seal returns meta information the way it is kept in the database.
+func (idx *Index) seal(data []byte) ([]byte, error) {
+	if idx.keys == nil {
+		return data, nil
+	}
+	return idx.keys.Seal(data)
+}
+
+// loadUploads fills in the files of every uploader from the database.
+func (idx *Index) loadUploads() error {
+	return idx.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).ForEach(func(k, v []byte) error {
+			data := v
+			if idx.keys != nil {
+				var err error
+				if data, err = idx.keys.Open(v); err != nil {
+					return err
+				}
+			}
+			idx.track(string(k), data)
+			return nil
+		})
+	})
+}
+
+// track records the uploader and size of the file with the meta
+// information data, replacing what was recorded for id before.
+func (idx *Index) track(id string, data []byte) {
+	var meta struct {
+		Uploader string
+		Size     uint64
+	}
+	json.Unmarshal(data, &meta)
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.untrackLocked(id)
+	if meta.Uploader == "" {
+		return
+	}
+	if idx.uploads[meta.Uploader] == nil {
+		idx.uploads[meta.Uploader] = make(map[string]uint64)
+	}
+	idx.uploads[meta.Uploader][id] = meta.Size
+	idx.uploaderOf[id] = meta.Uploader
+}
+
+// untrack forgets the file id.
+func (idx *Index) untrack(id string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.untrackLocked(id)
+}
+
+func (idx *Index) untrackLocked(id string) {
+	uploader, ok := idx.uploaderOf[id]
+	if !ok {
+		return
+	}
+	delete(idx.uploaderOf, id)
+	delete(idx.uploads[uploader], id)
+	if len(idx.uploads[uploader]) == 0 {
+		delete(idx.uploads, uploader)
+	}
+}
+
+// Uploads returns the IDs of the files uploaded by uploader and the bytes
+// they take.
+func (idx *Index) Uploads(uploader string) (ids []string, size uint64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for id, n := range idx.uploads[uploader] {
+		ids = append(ids, id)
+		size += n
+	}
+	sort.Strings(ids)
+	return
+}
+
+// Close closes the database.
+func (idx *Index) Close() error {
+	return idx.db.Close()
+}
+
+// Rebuild replaces the index with the contents of the storage.
+func (idx *Index) Rebuild() error {
+	idx.mu.Lock()
+	idx.uploaderOf = make(map[string]string)
+	idx.uploads = make(map[string]map[string]uint64)
+	idx.mu.Unlock()
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{objectsBucket, metaBucket, settingsBucket} {
+			if err := tx.DeleteBucket(name); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+				return err
+			}
+		}
+		objects, err := tx.CreateBucket(objectsBucket)
+		if err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucket(metaBucket)
+		if err != nil {
+			return err
+		}
+		settings, err := tx.CreateBucket(settingsBucket)
+		if err != nil {
+			return err
+		}
+		if err := settings.Put(sealedWithKey, []byte(idx.keyID())); err != nil {
+			return err
+		}
+		return idx.Storage.Walk("", func(info storage.ObjectInfo) error {
+			if passesThrough(info.Key) {
+				return nil
+			}
+			if err := putEntry(objects, info.Key, indexEntry{Size: info.Size, ModTime: info.ModTime}); err != nil {
+				return err
+			}
+			id, ok := metaID(info.Key)
+			if !ok {
+				return nil
+			}
+			f, err := idx.Storage.Get(info.Key)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			data, err := gunzipAll(f)
+			if err != nil {
+				log.Warn().Err(err).Str("key", info.Key).Msg("Skipping unreadable meta information")
+				return nil
+			}
+			idx.track(id, data)
+			if data, err = idx.seal(data); err != nil {
+				return err
+			}
+			return meta.Put([]byte(id), data)
+		})
+	})
+}
+
+// Meta returns the meta information of id as JSON.
+func (idx *Index) Meta(id string) (data []byte, err error) {
+	err = idx.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(metaBucket).Get([]byte(id))
+		if v == nil {
+			return storage.ErrNotExist
+		}
+		data = bytes.Clone(v)
+		return nil
+	})
+	if err == nil && idx.keys != nil {
+		data, err = idx.keys.Open(data)
+	}
+	return
+}
+
+func (idx *Index) Put(key string, r io.Reader) (int64, error) {
+	key = indexKey(key)
+	if passesThrough(key) {
+		return idx.Storage.Put(key, r)
+	}
+	// the meta information is small, it is kept to be indexed as well
+	id, isMeta := metaID(key)
+	buf := new(bytes.Buffer)
+	if isMeta {
+		r = io.TeeReader(r, buf)
+	}
+	n, err := idx.Storage.Put(key, r)
+	if err != nil {
+		return n, err
+	}
+	var plain, data []byte
+	if isMeta {
+		plain, err = gunzipAll(buf)
+		if err == nil {
+			data, err = idx.seal(plain)
+		}
+	}
+	if err == nil {
+		err = idx.db.Update(func(tx *bolt.Tx) error {
+			if err := putEntry(tx.Bucket(objectsBucket), key, indexEntry{Size: n, ModTime: time.Now()}); err != nil {
+				return err
+			}
+			if isMeta {
+				return tx.Bucket(metaBucket).Put([]byte(id), data)
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		// an object missing from the index would never be cleaned up
+		idx.Storage.Delete(key)
+	} else if isMeta {
+		idx.track(id, plain)
+	}
+	return n, err
+}
+
+// Delete and Move change the storage before the index, outside of the
+// transaction, so that slow backends do not hold up every other write. If
+// the storage fails halfway, the index is brought in line with it.
+func (idx *Index) Delete(key string) error {
+	key = indexKey(key)
+	if passesThrough(key) {
+		return idx.Storage.Delete(key)
+	}
+	// the index entries are only dropped if the objects are gone
+	deleteErr := idx.Storage.Delete(key)
+	if deleteErr != nil && !errors.Is(deleteErr, storage.ErrNotExist) {
+		if err := idx.reconcile(key); err != nil {
+			log.Warn().Err(err).Str("key", key).Msg("Error reconciling index")
+		}
+		return deleteErr
+	}
+	if err := idx.forget(key, nil); err != nil {
+		return err
+	}
+	return deleteErr
+}
+
+func (idx *Index) Move(src string, dst string) error {
+	src, dst = indexKey(src), indexKey(dst)
+	if passesThrough(src) && passesThrough(dst) {
+		return idx.Storage.Move(src, dst)
+	}
+	if err := idx.Storage.Move(src, dst); err != nil {
+		for _, key := range []string{src, dst} {
+			if err := idx.reconcile(key); err != nil {
+				log.Warn().Err(err).Str("key", key).Msg("Error reconciling index")
+			}
+		}
+		return err
+	}
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		objects := tx.Bucket(objectsBucket)
+		v := objects.Get([]byte(src))
+		if v == nil {
+			return nil
+		}
+		if err := objects.Put([]byte(dst), bytes.Clone(v)); err != nil {
+			return err
+		}
+		return objects.Delete([]byte(src))
+	})
+}
+
+// forget drops the entries of key and the objects below it, except the
+// ones in kept.
+func (idx *Index) forget(key string, kept map[string]storage.ObjectInfo) error {
+	var deletedIDs []string
+	err := idx.db.Update(func(tx *bolt.Tx) error {
+		objects := tx.Bucket(objectsBucket)
+		var keys [][]byte
+		scan(objects, key, func(k, v []byte) error {
+			if _, ok := kept[string(k)]; !ok {
+				keys = append(keys, bytes.Clone(k))
+			}
+			return nil
+		})
+		for _, k := range keys {
+			if err := objects.Delete(k); err != nil {
+				return err
+			}
+			if id, ok := metaID(string(k)); ok {
+				if err := tx.Bucket(metaBucket).Delete([]byte(id)); err != nil {
+					return err
+				}
+				deletedIDs = append(deletedIDs, id)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range deletedIDs {
+		idx.untrack(id)
+	}
+	return nil
+}
+
+// reconcile makes the entries of key and the objects below it match the
+// storage, like Rebuild does for everything. Meta information that shows
+// up is left to Rebuild, Delete and Move never bring any back.
+func (idx *Index) reconcile(key string) error {
+	stored := make(map[string]storage.ObjectInfo)
+	// walking does not find the object named like the prefix everywhere
+	if info, err := idx.Storage.Stat(key); err == nil {
+		stored[key] = info
+	} else if !errors.Is(err, storage.ErrNotExist) {
+		return err
+	}
+	err := idx.Storage.Walk(key, func(info storage.ObjectInfo) error {
+		stored[info.Key] = info
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := idx.forget(key, stored); err != nil {
+		return err
+	}
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		objects := tx.Bucket(objectsBucket)
+		for k, info := range stored {
+			if objects.Get([]byte(k)) != nil {
+				continue
+			}
+			if err := putEntry(objects, k, indexEntry{Size: info.Size, ModTime: info.ModTime}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (idx *Index) Stat(key string) (info storage.ObjectInfo, err error) {
+	key = indexKey(key)
+	if passesThrough(key) {
+		return idx.Storage.Stat(key)
+	}
+	err = idx.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(objectsBucket).Get([]byte(key))
+		if v == nil {
+			return storage.ErrNotExist
+		}
+		var entry indexEntry
+		if err := json.Unmarshal(v, &entry); err != nil {
+			return err
+		}
+		info = storage.ObjectInfo{Key: key, Size: entry.Size, ModTime: entry.ModTime}
+		return nil
+	})
+	return
+}
+
+func (idx *Index) List(prefix string) (names []string, err error) {
+	prefix = indexKey(prefix)
+	if passesThrough(prefix) {
+		return idx.Storage.List(prefix)
+	}
+	seen := make(map[string]bool)
+	if prefix == "" {
+		// auth is listed if the storage has anything below it
+		if auth, err := idx.Storage.List(authDir); err != nil {
+			return nil, err
+		} else if len(auth) > 0 {
+			seen[authDir] = true
+			names = append(names, authDir)
+		}
+	}
+	err = idx.db.View(func(tx *bolt.Tx) error {
+		return scan(tx.Bucket(objectsBucket), prefix, func(k, v []byte) error {
+			if passesThrough(string(k)) {
+				// left over from before auth was left out
+				return nil
+			}
+			rest := strings.TrimPrefix(strings.TrimPrefix(string(k), prefix), "/")
+			name, _, _ := strings.Cut(rest, "/")
+			if name != "" && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+			return nil
+		})
+	})
+	sort.Strings(names)
+	return
+}
+
+func (idx *Index) Walk(prefix string, fn func(storage.ObjectInfo) error) error {
+	prefix = indexKey(prefix)
+	if passesThrough(prefix) {
+		return idx.Storage.Walk(prefix, fn)
+	}
+	var infos []storage.ObjectInfo
+	err := idx.db.View(func(tx *bolt.Tx) error {
+		return scan(tx.Bucket(objectsBucket), prefix, func(k, v []byte) error {
+			if passesThrough(string(k)) {
+				return nil
+			}
+			var entry indexEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			infos = append(infos, storage.ObjectInfo{Key: string(k), Size: entry.Size, ModTime: entry.ModTime})
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	// fn may change the storage, so it is not called inside the transaction
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	if prefix == "" {
+		return idx.Storage.Walk(authDir, fn)
+	}
+	return nil
+}
+
+func putEntry(objects *bolt.Bucket, key string, entry indexEntry) error {
+	v, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return objects.Put([]byte(key), v)
+}
+
+// scan calls fn for prefix and every key below it, in order.
+func scan(objects *bolt.Bucket, prefix string, fn func(k, v []byte) error) error {
+	if prefix == "" {
+		return objects.ForEach(fn)
+	}
+	if v := objects.Get([]byte(prefix)); v != nil {
+		if err := fn([]byte(prefix), v); err != nil {
+			return err
+		}
+	}
+	// "id-x" sorts between "id" and "id/x", so the children are sought
+	// separately
+	c := objects.Cursor()
+	dir := []byte(prefix + "/")
+	for k, v := c.Seek(dir); k != nil && bytes.HasPrefix(k, dir); k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// passesThrough reports whether key is left out of the index.
+func passesThrough(key string) bool {
+	return key == authDir || strings.HasPrefix(key, authDir+"/")
+}
+
+// indexKey cleans key the way the storage backends do.
+func indexKey(key string) string {
+	return strings.TrimPrefix(path.Clean("/"+key), "/")
+}
+
+// metaID returns the ID if key is the meta information of a file.
+func metaID(key string) (string, bool) {
+	id, _, _ := strings.Cut(key, "/")
+	return id, key == metaKey(id)
+}
+
+func gunzipAll(r io.Reader) ([]byte, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+	return io.ReadAll(gr)
+}
@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tuilakhanh/webshare/internal/config"
+	"github.com/tuilakhanh/webshare/internal/storage"
+)
+
+// newTestIndex returns an index of store, as a running server holds it.
+func newTestIndex(t *testing.T, store storage.Storage) *Index {
+	t.Helper()
+	return newTestIndexAt(t, filepath.Join(t.TempDir(), "index.db"), store)
+}
+
+func newTestIndexAt(t *testing.T, file string, store storage.Storage) *Index {
+	t.Helper()
+	idx, err := OpenIndex(file, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { idx.Close() })
+	return idx
+}
+
+// The admin commands write API tokens to the storage itself while a server
+// holds the index, the server must see them right away.
+func TestIndexTokens(t *testing.T) {
+	store := storage.NewMemory()
+	idx := newTestIndex(t, store)
+	admin := NewServer(&config.Config{}, store)
+
+	token, err := admin.CreateToken("ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _, _ := strings.Cut(token, ".")
+	if _, err := loadValidToken(idx, token); err != nil {
+		t.Errorf("loadValidToken: %v", err)
+	}
+	if tokens, err := loadTokens(idx); err != nil || len(tokens) != 1 || tokens[0].ID != id {
+		t.Errorf("loadTokens: got %v, %v, want the new token", tokens, err)
+	}
+	if _, err := idx.Stat(tokenKey(id)); err != nil {
+		t.Errorf("Stat: %v", err)
+	}
+	if names, err := idx.List(""); err != nil || !slices.Contains(names, authDir) {
+		t.Errorf("List: got %v, %v, want %s listed", names, err, authDir)
+	}
+	if keys := walkKeys(t, idx, ""); !slices.Contains(keys, tokenKey(id)) {
+		t.Errorf("Walk: got %v, want the token", keys)
+	}
+
+	if err := admin.RevokeToken(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadValidToken(idx, token); err == nil {
+		t.Error("loadValidToken: the revoked token is still valid")
+	}
+}
+
+// The same goes for the accounts.
+func TestIndexAccounts(t *testing.T) {
+	store := storage.NewMemory()
+	idx := newTestIndex(t, store)
+	admin := NewServer(&config.Config{}, store)
+
+	if err := admin.CreateUser("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if accounts, err := loadAccounts(idx); err != nil || len(accounts) != 1 || accounts[0].Name != "alice" {
+		t.Errorf("loadAccounts: got %v, %v, want alice", accounts, err)
+	}
+	if exists, err := storage.Exists(idx, accountKey("alice")); err != nil || !exists {
+		t.Errorf("Exists: got %v, %v, want true", exists, err)
+	}
+
+	if err := admin.DeleteUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadAccount(idx, "alice"); !errors.Is(err, errNoAccount) {
+		t.Errorf("loadAccount: got %v, want errNoAccount", err)
+	}
+	if accounts, err := loadAccounts(idx); err != nil || len(accounts) != 0 {
+		t.Errorf("loadAccounts: got %v, %v, want none", accounts, err)
+	}
+}
+
+func TestIndexUploads(t *testing.T) {
+	store := storage.NewMemory()
+	file := filepath.Join(t.TempDir(), "index.db")
+	idx, err := OpenIndex(file, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, size := range map[string]uint64{"a": 10, "b": 20} {
+		if err := writeGzippedJSON(&Page{ID: id, Size: size, Uploader: "user:alice"}, metaKey(id), idx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeGzippedJSON(&Page{ID: "c", Size: 40}, metaKey("c"), idx); err != nil {
+		t.Fatal(err)
+	}
+	if ids, size := idx.Uploads("user:alice"); !slices.Equal(ids, []string{"a", "b"}) || size != 30 {
+		t.Errorf("Uploads: got %v, %d, want a and b with 30 bytes", ids, size)
+	}
+	if err := idx.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if ids, size := idx.Uploads("user:alice"); !slices.Equal(ids, []string{"b"}) || size != 20 {
+		t.Errorf("Uploads after deleting: got %v, %d, want b with 20 bytes", ids, size)
+	}
+
+	// the uploads are read from the database when it is opened again
+	idx.Close()
+	idx = newTestIndexAt(t, file, store)
+	if ids, size := idx.Uploads("user:alice"); !slices.Equal(ids, []string{"b"}) || size != 20 {
+		t.Errorf("Uploads after reopening: got %v, %d, want b with 20 bytes", ids, size)
+	}
+}
+
+// failingStorage fails deleting and moving halfway: it deletes only the
+// first object of a prefix and copies objects without removing them.
+type failingStorage struct {
+	*storage.Memory
+}
+
+var errBackend = errors.New("backend failed")
+
+func (f failingStorage) Delete(key string) error {
+	var first string
+	f.Memory.Walk(key, func(info storage.ObjectInfo) error {
+		if first == "" {
+			first = info.Key
+		}
+		return nil
+	})
+	if first != "" {
+		f.Memory.Delete(first)
+	}
+	return errBackend
+}
+
+func (f failingStorage) Move(src string, dst string) error {
+	r, err := f.Memory.Get(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err := f.Memory.Put(dst, r); err != nil {
+		return err
+	}
+	return errBackend
+}
+
+// When the storage fails halfway, the index keeps what is left of it.
+func TestIndexReconcile(t *testing.T) {
+	idx := newTestIndex(t, failingStorage{storage.NewMemory()})
+	for _, key := range []string{"x/a", "x/b", "y"} {
+		if _, err := idx.Put(key, strings.NewReader(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := idx.Delete("x"); !errors.Is(err, errBackend) {
+		t.Fatalf("Delete: got %v, want the error of the storage", err)
+	}
+	if keys := walkKeys(t, idx, "x"); !slices.Equal(keys, []string{"x/b"}) {
+		t.Errorf("Walk after deleting: got %v, want x/b left", keys)
+	}
+
+	if err := idx.Move("y", "z"); !errors.Is(err, errBackend) {
+		t.Fatalf("Move: got %v, want the error of the storage", err)
+	}
+	for _, key := range []string{"y", "z"} {
+		if info, err := idx.Stat(key); err != nil || info.Size != 1 {
+			t.Errorf("Stat(%q) after moving: got %+v, %v, want the object", key, info, err)
+		}
+	}
+}
+
+func walkKeys(t *testing.T, s storage.Storage, prefix string) (keys []string) {
+	t.Helper()
+	err := s.Walk(prefix, func(info storage.ObjectInfo) error {
+		keys = append(keys, info.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
@@ -0,0 +1,233 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2"
+
+	"github.com/tuilakhanh/webshare/internal/config"
+	"github.com/tuilakhanh/webshare/internal/pkg"
+)
+
+// Signing in to the web interface with OpenID Connect uses the authorization
+// code flow with PKCE. The state, the nonce and the PKCE verifier of a sign
+// in in progress are kept in a signed cookie until the provider redirects
+// back.
+const loginCookie = "webshare_login"
+
+// loginTimeout is how long the user has to sign in at the provider.
+const loginTimeout = 10 * time.Minute
+
+// oidcLogin talks to the OpenID Connect provider. The provider is discovered
+// on the first sign in, so that the server starts while it is unreachable.
+type oidcLogin struct {
+	config *config.Config
+
+	mu       sync.Mutex
+	verifier *oidc.IDTokenVerifier
+	oauth2   oauth2.Config
+}
+
+func newOIDCLogin(cfg *config.Config) *oidcLogin {
+	if cfg.OIDCIssuer == "" {
+		return nil
+	}
+	return &oidcLogin{config: cfg}
+}
+
+// setup discovers the provider unless that was done already.
+func (o *oidcLogin) setup(ctx context.Context) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.verifier != nil {
+		return nil
+	}
+	provider, err := oidc.NewProvider(ctx, o.config.OIDCIssuer)
+	if err != nil {
+		return err
+	}
+	scopes := []string{oidc.ScopeOpenID, "email", "profile"}
+	if o.config.OIDCAllowedGroups != "" {
+		// most providers only add the groups if asked for them
+		scopes = append(scopes, o.config.OIDCGroupsClaim)
+	}
+	o.oauth2 = oauth2.Config{
+		ClientID:     o.config.OIDCClientID,
+		ClientSecret: o.config.OIDCClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  strings.TrimSuffix(o.config.PublicURL, "/") + "/auth/callback",
+		Scopes:       scopes,
+	}
+	o.verifier = provider.Verifier(&oidc.Config{ClientID: o.config.OIDCClientID})
+	return nil
+}
+
+// allowed reports whether the user with the given verified email address
+// and groups may sign in. Without a list of emails or groups everyone the
+// provider authenticates may.
+func (o *oidcLogin) allowed(email string, groups []string) bool {
+	emails := splitList(o.config.OIDCAllowedEmails)
+	allowedGroups := splitList(o.config.OIDCAllowedGroups)
+	if len(emails) == 0 && len(allowedGroups) == 0 {
+		return true
+	}
+	email = strings.ToLower(email)
+	for _, allowed := range emails {
+		allowed = strings.ToLower(allowed)
+		if email == allowed || (strings.HasPrefix(allowed, "@") && strings.HasSuffix(email, allowed)) {
+			return true
+		}
+	}
+	for _, group := range groups {
+		if slices.Contains(allowedGroups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a comma separated list from the config.
+func splitList(list string) (items []string) {
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return
+}
+
+// handleLogin sends the browser to the provider to sign in.
+func (s *Server) handleLogin(c *gin.Context) {
+	if err := s.oidc.setup(c.Request.Context()); err != nil {
+		log.Error().Err(err).Str("issuer", s.config.OIDCIssuer).Msg("Error discovering OpenID Connect provider")
+		s.showLoginError(c, http.StatusBadGateway, "The sign in provider is not available.")
+		return
+	}
+	state, _, err := pkg.NewSecret()
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	nonce, _, err := pkg.NewSecret()
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+	next := safeRedirect(c.Query("next"))
+
+	expires := time.Now().Add(loginTimeout)
+	value := strings.Join([]string{strconv.FormatInt(expires.Unix(), 10), state, nonce, verifier, next}, "|")
+	s.setCookie(c, loginCookie, pkg.SignValue(s.sessionKey(), value), expires)
+	c.Redirect(http.StatusFound, s.oidc.oauth2.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier), oidc.Nonce(nonce)))
+}
+
+// errLoginDenied is returned for users the config does not allow in.
+var errLoginDenied = errors.New("You are not allowed to upload here.")
+
+// handleLoginCallback finishes the sign in the provider redirected back
+// from and starts the session.
+func (s *Server) handleLoginCallback(c *gin.Context) {
+	cookie, err := c.Cookie(loginCookie)
+	if err != nil {
+		s.showLoginError(c, http.StatusBadRequest, "The sign in expired, please try again.")
+		return
+	}
+	s.clearCookie(c, loginCookie)
+	value, ok := pkg.VerifyValue(s.sessionKey(), cookie)
+	fields := strings.SplitN(value, "|", 5)
+	if !ok || len(fields) != 5 {
+		s.showLoginError(c, http.StatusBadRequest, "The sign in expired, please try again.")
+		return
+	}
+	expires, state, nonce, verifier, next := fields[0], fields[1], fields[2], fields[3], fields[4]
+	if expiresUnix, err := strconv.ParseInt(expires, 10, 64); err != nil || time.Now().Unix() >= expiresUnix {
+		s.showLoginError(c, http.StatusBadRequest, "The sign in expired, please try again.")
+		return
+	}
+	if c.Query("state") != state {
+		s.showLoginError(c, http.StatusBadRequest, "The sign in expired, please try again.")
+		return
+	}
+	if errCode := c.Query("error"); errCode != "" {
+		log.Info().Str("error", errCode).Str("description", c.Query("error_description")).Msg("Sign in failed at the provider")
+		s.showLoginError(c, http.StatusUnauthorized, "Signing in failed.")
+		return
+	}
+
+	email, groups, err := s.finishLogin(c.Request.Context(), c.Query("code"), verifier, nonce)
+	if errors.Is(err, errLoginDenied) {
+		s.showLoginError(c, http.StatusForbidden, err.Error())
+		return
+	} else if err != nil {
+		log.Warn().Err(err).Msg("Error finishing sign in")
+		s.showLoginError(c, http.StatusUnauthorized, "Signing in failed.")
+		return
+	}
+
+	log.Info().Str("email", email).Msg("Signed in")
+	s.startSession(c, session{Identity: "oidc:" + email, Groups: groups})
+	c.Redirect(http.StatusSeeOther, next)
+}
+
+// finishLogin exchanges the code for the ID token, checks it and returns
+// the email address and groups of the user if the user is allowed in.
+func (s *Server) finishLogin(ctx context.Context, code string, verifier string, nonce string) (email string, groups []string, err error) {
+	if err = s.oidc.setup(ctx); err != nil {
+		return
+	}
+	token, err := s.oidc.oauth2.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return "", nil, errors.New("no ID token in the token response")
+	}
+	idToken, err := s.oidc.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return
+	}
+	if idToken.Nonce != nonce {
+		return "", nil, errors.New("nonce of the ID token does not match")
+	}
+
+	var claims map[string]any
+	if err = idToken.Claims(&claims); err != nil {
+		return
+	}
+	email, _ = claims["email"].(string)
+	// the email address is the identity that owns uploads and quotas, so
+	// the provider has to vouch for it, or anyone could claim the address
+	// of someone else and take over their files
+	verified, _ := claims["email_verified"].(bool)
+	if email == "" || !verified {
+		return "", nil, fmt.Errorf("%w The provider did not tell a verified email address.", errLoginDenied)
+	}
+	switch g := claims[s.config.OIDCGroupsClaim].(type) {
+	case string:
+		groups = []string{g}
+	case []any:
+		for _, group := range g {
+			if group, ok := group.(string); ok {
+				groups = append(groups, group)
+			}
+		}
+	}
+	if !s.oidc.allowed(email, groups) {
+		log.Info().Str("email", email).Strs("groups", groups).Msg("Sign in denied")
+		return "", nil, errLoginDenied
+	}
+	return email, groups, nil
+}
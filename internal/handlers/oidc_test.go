@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/tuilakhanh/webshare/internal/config"
+	"github.com/tuilakhanh/webshare/internal/mockoidc"
+)
+
+// oidcTest is a server that signs in with the mock OpenID Connect provider.
+type oidcTest struct {
+	*testServer
+	provider *httptest.Server
+}
+
+func newOIDCTest(t *testing.T, configure func(*config.Config)) *oidcTest {
+	t.Helper()
+	mock, err := mockoidc.New("webshare", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := httptest.NewServer(mock)
+	t.Cleanup(provider.Close)
+	mock.Issuer = provider.URL
+
+	ts := newTestServer(t, func(cfg *config.Config) {
+		cfg.OIDCIssuer = provider.URL
+		cfg.OIDCClientID = "webshare"
+		if configure != nil {
+			configure(cfg)
+		}
+	})
+	return &oidcTest{testServer: ts, provider: provider}
+}
+
+// login signs in at the mock provider with the given form fields, which
+// tamper may change before they are posted, and returns the response of the
+// callback.
+func (o *oidcTest) login(t *testing.T, fields url.Values, tamper func(url.Values)) *http.Response {
+	t.Helper()
+	resp := o.get(t, o.app.URL+"/auth/login")
+	authorize, err := url.Parse(resp.Header.Get("Location"))
+	if resp.StatusCode != http.StatusFound || err != nil || !strings.HasPrefix(authorize.String(), o.provider.URL) {
+		t.Fatalf("login: got %s to %q, want a redirect to the provider", resp.Status, authorize)
+	}
+
+	form := authorize.Query()
+	for k, v := range fields {
+		form[k] = v
+	}
+	if tamper != nil {
+		tamper(form)
+	}
+	authorize.RawQuery = ""
+	resp, err = o.client.PostForm(authorize.String(), form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusFound || !strings.HasPrefix(callback, o.app.URL+"/auth/callback") {
+		t.Fatalf("authorize: got %s to %q, want a redirect to the callback", resp.Status, callback)
+	}
+	return o.get(t, callback)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	allowCorp := func(cfg *config.Config) { cfg.OIDCAllowedEmails = "@corp.example" }
+
+	t.Run("success", func(t *testing.T) {
+		o := newOIDCTest(t, allowCorp)
+		resp := o.login(t, url.Values{"email": {"alice@corp.example"}}, nil)
+		if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/" {
+			t.Fatalf("callback: got %s to %q, want a redirect home", resp.Status, resp.Header.Get("Location"))
+		}
+		if home := body(t, o.get(t, o.app.URL+"/")); !strings.Contains(home, "Signed in as alice@corp.example") {
+			t.Errorf("home page does not show the user signed in:\n%s", home)
+		}
+		if !o.signedIn(t) {
+			t.Error("the session is not accepted")
+		}
+	})
+
+	t.Run("wrong state", func(t *testing.T) {
+		o := newOIDCTest(t, allowCorp)
+		resp := o.login(t, url.Values{"email": {"alice@corp.example"}}, func(form url.Values) {
+			form.Set("state", "forged")
+		})
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("callback: got %s, want %d", resp.Status, http.StatusBadRequest)
+		}
+		if o.signedIn(t) {
+			t.Error("signed in with a forged state")
+		}
+	})
+
+	t.Run("wrong nonce", func(t *testing.T) {
+		o := newOIDCTest(t, allowCorp)
+		resp := o.login(t, url.Values{"email": {"alice@corp.example"}}, func(form url.Values) {
+			form.Set("nonce", "replayed")
+		})
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("callback: got %s, want %d", resp.Status, http.StatusUnauthorized)
+		}
+		if o.signedIn(t) {
+			t.Error("signed in with a token for another nonce")
+		}
+	})
+
+	t.Run("denied email", func(t *testing.T) {
+		o := newOIDCTest(t, allowCorp)
+		resp := o.login(t, url.Values{"email": {"mallory@other.example"}}, nil)
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("callback: got %s, want %d", resp.Status, http.StatusForbidden)
+		}
+		if o.signedIn(t) {
+			t.Error("signed in with an email address that is not allowed")
+		}
+	})
+
+	t.Run("unverified email", func(t *testing.T) {
+		o := newOIDCTest(t, allowCorp)
+		resp := o.login(t, url.Values{"email": {"alice@corp.example"}, "unverified": {"on"}}, nil)
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("callback: got %s, want %d", resp.Status, http.StatusForbidden)
+		}
+		if o.signedIn(t) {
+			t.Error("signed in with an email address the provider did not verify")
+		}
+	})
+
+	t.Run("removed from the allowlist", func(t *testing.T) {
+		o := newOIDCTest(t, allowCorp)
+		o.login(t, url.Values{"email": {"alice@corp.example"}}, nil)
+		if !o.signedIn(t) {
+			t.Fatal("the session is not accepted")
+		}
+		o.server.config.OIDCAllowedEmails = "bob@corp.example"
+		if o.signedIn(t) {
+			t.Error("the session outlived the removal from the allowlist")
+		}
+	})
+
+	t.Run("allowed group", func(t *testing.T) {
+		o := newOIDCTest(t, func(cfg *config.Config) { cfg.OIDCAllowedGroups = "staff" })
+		resp := o.login(t, url.Values{"email": {"bob@other.example"}, "groups": {"guests, staff"}}, nil)
+		if resp.StatusCode != http.StatusSeeOther || !o.signedIn(t) {
+			t.Errorf("callback: got %s, want to be signed in", resp.Status)
+		}
+	})
+
+	t.Run("unverified email without an allowlist", func(t *testing.T) {
+		o := newOIDCTest(t, func(cfg *config.Config) { cfg.OIDCAllowedGroups = "staff" })
+		resp := o.login(t, url.Values{"email": {"alice@corp.example"}, "groups": {"staff"}, "unverified": {"on"}}, nil)
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("callback: got %s, want %d", resp.Status, http.StatusForbidden)
+		}
+		if o.signedIn(t) {
+			t.Error("signed in as the owner of an email address the provider did not verify")
+		}
+	})
+
+	t.Run("denied at the provider", func(t *testing.T) {
+		o := newOIDCTest(t, nil)
+		resp := o.login(t, url.Values{"email": {"alice@corp.example"}, "deny": {"on"}}, nil)
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("callback: got %s, want %d", resp.Status, http.StatusUnauthorized)
+		}
+	})
+}
@@ -2,26 +2,34 @@ package handlers
 
 import (
 	"bytes"
-	"compress/gzip"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
+	"mime/multipart"
 	"net/http"
-	"os"
+	"path"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog/log"
 
 	"github.com/tuilakhanh/webshare/internal/config"
+	"github.com/tuilakhanh/webshare/internal/pkg"
+	"github.com/tuilakhanh/webshare/internal/storage"
 )
 
 // Page defines content that is available to each page
 type Page struct {
 	// properties of the file
-	ID            string
-	Name          string
-	PathToFile    string
+	ID string
+	// Name is the sanitized file name used in URLs
+	Name string
+	// DisplayName is the file name as uploaded, empty for files stored
+	// before it was kept
+	DisplayName string
+	PathToFile  string
+	// Hash is the MD5 of files stored before SHA256 was computed
 	Hash          string
 	Link          string
 	Size          uint64
@@ -34,117 +42,320 @@ type Page struct {
 	IsAudio       bool
 	IsVideo       bool
 	IsASCII       bool
+	// SHA256 and BLAKE3 are the checksums of the original data in hex,
+	// BLAKE3 only if the server or the uploader asked for it
+	SHA256 string
+	BLAKE3 string
+	// Encrypted is set if the data was encrypted end-to-end by the
+	// uploader, EncryptedMeta holds the name and type of the file sealed
+	// with the same key
+	Encrypted     bool
+	EncryptedMeta string
+	// Codec the data is stored with, empty means gzip
+	Codec string
+	// Blob holding the data, empty for files stored before deduplication
+	// whose data is stored under <id>/<name>
+	Blob string
+	// DeleteTokenHash is the hash of the token needed to delete the file
+	DeleteTokenHash string
+	// PasswordHash is the bcrypt hash of the password protecting the file
+	PasswordHash string
+	// MaxDownloads is the number of downloads after which the file is
+	// deleted, 0 means unlimited
+	MaxDownloads int
+	// ExpiresAt is when the file is deleted, zero for metadata written
+	// before it was stored
+	ExpiresAt time.Time
+	// Uploader identifies who uploaded the file, token:<id> for an API
+	// token or oidc:<email> for a user signed in to the web interface, empty
+	// for anonymous uploads
+	Uploader string
 
 	// computed properties
 	NameOnDisk          string
 	Text                string
 	TimeToDeletion      time.Duration
 	TimeToDeletionHuman string
+	Locked              bool
+	DownloadsRemaining  int
+	// legacyExpiry is set if ExpiresAt was computed, not stored
+	legacyExpiry bool
 
 	// page specific info
 	Error string
+	// User is the name of the user signed in to the web interface
+	User string `json:"-"`
+	// SignInRequired is set if uploading from the web interface requires
+	// signing in first
+	SignInRequired bool `json:"-"`
+	// MyUploads is set for the list of the files of the signed in user,
+	// Uploads, along with their storage usage
+	MyUploads bool    `json:"-"`
+	Uploads   []*Page `json:"-"`
+	Usage     string  `json:"-"`
+	// Downloads is the number of times the file was downloaded
+	Downloads int `json:"-"`
 
-	// Config data
-	Config config.Config
+	// Config data, never stored with the meta information
+	Config config.Config `json:"-"`
+
+	store storage.Storage
 }
 
-func NewPage(config config.Config) (p *Page) {
+func NewPage(config config.Config, store storage.Storage) (p *Page) {
 	p = new(Page)
 	p.Config = config
+	p.store = store
 	return
 }
 
-func (p *Page) handlePost(c *gin.Context) (err error) {
-	fileHeader, err := c.FormFile("file")
+// maxFieldSize is the most bytes a form field other than the file may have.
+const maxFieldSize = 1024
+
+// multipartOverhead is the room left on top of the max file size for the
+// multipart boundaries and headers of an upload.
+const multipartOverhead = 1 << 20
+
+// handlePost stores the uploaded file and returns its page. Files larger
+// than maxBytes are rejected with tooLargeMessage.
+func (p *Page) handlePost(c *gin.Context, maxBytes int64, tooLargeMessage string) (stored *Page, err error) {
+	tooLarge := gin.H{"message": tooLargeMessage}
+	if c.Request.ContentLength > maxBytes+multipartOverhead {
+		c.JSON(http.StatusBadRequest, tooLarge)
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes+multipartOverhead)
+
+	// read the multipart body as a stream instead of letting it be
+	// spooled to a temporary file first
+	reader, err := c.Request.MultipartReader()
 	if err != nil {
-		log.Error().Err(err).Msg("Error getting file from form")
+		log.Error().Err(err).Msg("Error reading multipart form")
 		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
 		return
 	}
+	// the other form fields have to come before the file, it is stored
+	// while it is being read
+	opts := uploadOptions{Uploader: uploader(c)}
+	var part *multipart.Part
+	for {
+		part, err = reader.NextPart()
+		if err == io.EOF {
+			err = errors.New("no file in upload")
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("Error getting file from form")
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+		if part.FormName() == "file" && part.FileName() != "" {
+			break
+		}
+		var value []byte
+		value, err = io.ReadAll(io.LimitReader(part, maxFieldSize+1))
+		if err != nil {
+			log.Error().Err(err).Msg("Error reading form field")
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+		if len(value) > maxFieldSize {
+			err = fmt.Errorf("form field %q is longer than %d bytes", part.FormName(), maxFieldSize)
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+		if err = opts.set(part.FormName(), string(value)); errors.Is(err, errPasswordTooLong) {
+			c.JSON(http.StatusBadRequest, gin.H{"message": passwordTooLongMessage})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+		part.Close()
+	}
+	defer part.Close()
 
-	if fileHeader.Size > p.Config.MaxBytesPerFile {
-		c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Upload exceeds max file size: %s.", p.Config.MaxBytesPerFileHuman)})
+	file := http.MaxBytesReader(c.Writer, part, maxBytes)
+	stored, deleteToken, err := copyToContentDirectory(part.FileName(), file, opts, p.Config, p.store)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		c.JSON(http.StatusBadRequest, tooLarge)
+		return
+	} else if errors.Is(err, errChecksumMismatch) || errors.Is(err, pkg.ErrInvalidFilename) || errors.Is(err, errNotEncrypted) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error processing file"})
 		return
 	}
 
-	file, err := fileHeader.Open()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Unable to open uploaded file"})
-		return
+	response := gin.H{
+		"id":           path.Join(stored.ID, stored.Name),
+		"delete_token": deleteToken,
+		"expires_at":   stored.ExpiresAt,
+		"sha256":       stored.SHA256,
+	}
+	if stored.BLAKE3 != "" {
+		response["blake3"] = stored.BLAKE3
 	}
-	defer file.Close()
+	c.JSON(http.StatusCreated, response)
+	return
+}
 
-	tempFile, err := os.CreateTemp(p.Config.ContentDirectory, "upload_")
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Unable to create temporary file"})
+func (p *Page) handleGetData(w http.ResponseWriter, r *http.Request) (err error) {
+	contentType, disposition := p.safeContentType(r)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", pkg.ContentDisposition(disposition, p.DisplayName))
+	setContentSafetyHeaders(w)
+	if p.Encrypted {
+		w.Header().Set("Webshare-Encrypted-Meta", p.EncryptedMeta)
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	// the stored data can be passed through as is, everything else has
+	// to be decoded first. Data stored uncompressed did not compress well,
+	// it is not compressed on the fly either.
+	codec := p.codec()
+	offers := []string{codec}
+	if codec != pkg.CodecIdentity {
+		for _, encoding := range append([]string{pkg.CodecIdentity}, transcodeEncodings...) {
+			if encoding != codec {
+				offers = append(offers, encoding)
+			}
+		}
+	}
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), offers)
+	if encoding == "" {
+		http.Error(w, "None of the accepted encodings is available", http.StatusNotAcceptable)
 		return
 	}
-	defer os.Remove(tempFile.Name())
 
-	gzWriter := gzip.NewWriter(tempFile)
-	defer gzWriter.Close()
+	if encoding == pkg.CodecIdentity || r.Header.Get("Range") != "" {
+		// ranges always refer to the uncompressed data
+		content, err := p.openSeekable()
+		if err != nil {
+			log.Error().Err(err).Msg("Error opening file")
+			http.Error(w, "Failed to access file", http.StatusInternalServerError)
+			return err
+		}
+		defer content.Close()
+		if etag := p.etag(); etag != "" {
+			w.Header().Set("ETag", `"`+etag+`"`)
+		}
+		p.setDigestHeaders(w)
+		// takes care of If-None-Match, If-Modified-Since, If-Range and the ranges
+		http.ServeContent(w, r, p.Name, p.Modified, content)
+		return nil
+	}
 
-	_, err = io.Copy(gzWriter, file)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Unable to compress file"})
+	etag := ""
+	if p.etag() != "" {
+		etag = `"` + p.etag() + "-" + encoding + `"`
+		w.Header().Set("ETag", etag)
+	}
+	w.Header().Set("Last-Modified", p.Modified.UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Encoding", encoding)
+	if notModified(r, etag, p.Modified) {
+		writeNotModified(w)
+		return
+	}
+	if r.Method == http.MethodHead {
 		return
 	}
 
-	err = gzWriter.Close()
+	var f io.ReadCloser
+	recode := encoding
+	if encoding == codec {
+		// the stored data is sent as it is
+		f, err = p.store.Get(p.NameOnDisk)
+		recode = pkg.CodecIdentity
+	} else {
+		f, err = p.openDecompressed()
+	}
+	var encoder io.WriteCloser
+	if err == nil {
+		if encoder, err = newEncoder(w, recode); err != nil {
+			f.Close()
+		}
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Unable to close gzip writer"})
+		log.Error().Err(err).Msg("Error opening file")
+		w.Header().Del("Content-Encoding")
+		http.Error(w, "Failed to access file", http.StatusInternalServerError)
 		return
 	}
+	defer f.Close()
 
-	finalname, err := copyToContentDirectory(fileHeader.Filename, tempFile.Name(), uint64(fileHeader.Size), p.Config)
+	if _, err = io.Copy(encoder, f); err == nil {
+		err = encoder.Close()
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error processing file"})
-		return
+		log.Debug().Err(err).Str("id", p.ID).Msg("Error sending file")
 	}
+	return
+}
 
-	if err := tempFile.Close(); err != nil {
-		log.Warn().Err(err).Msg("Error closing temporary file")
+// codec returns the codec the data is stored with.
+func (p *Page) codec() string {
+	if p.Codec == "" {
+		return pkg.CodecGzip
 	}
+	return p.Codec
+}
 
-	c.JSON(http.StatusCreated, gin.H{"id": finalname})
-	return
+// openSeekable opens the decoded data for random access. Data that is stored
+// uncompressed is seeked in the storage directly if the backend allows it.
+func (p *Page) openSeekable() (io.ReadSeekCloser, error) {
+	if p.codec() == pkg.CodecIdentity {
+		f, err := p.store.Get(p.NameOnDisk)
+		if err != nil {
+			return nil, err
+		}
+		if rsc, ok := f.(io.ReadSeekCloser); ok {
+			return rsc, nil
+		}
+		f.Close()
+	}
+	return pkg.NewSeeker(p.openDecompressed, int64(p.Size)), nil
 }
 
-func (p *Page) handleGetData(w http.ResponseWriter, decompress bool) (err error) {
-	f, err := os.Open(p.NameOnDisk)
+// openDecompressed opens the stored data and decodes it on the fly.
+func (p *Page) openDecompressed() (io.ReadCloser, error) {
+	f, err := p.store.Get(p.NameOnDisk)
 	if err != nil {
-		log.Error().Err(err).Msg("Error opening file")
-		return
+		return nil, err
 	}
-	if decompress {
-		gzf, _ := gzip.NewReader(f)
-		defer gzf.Close()
-		io.Copy(w, gzf)
-	} else {
-		w.Header().Set("Content-Encoding", "gzip")
-		w.Header().Set("Content-Type", p.ContentType)
-		io.Copy(w, f)
+	cr, err := pkg.NewCodecReader(f, p.codec())
+	if err != nil {
+		f.Close()
+		return nil, err
 	}
-	return
+	return &decompressedReader{ReadCloser: cr, file: f}, nil
+}
+
+// decompressedReader closes the stored file along with the decoder.
+type decompressedReader struct {
+	io.ReadCloser
+	file io.Closer
+}
+
+func (d *decompressedReader) Close() error {
+	d.ReadCloser.Close()
+	return d.file.Close()
 }
 
 func (p *Page) handleShowDataInBrowser(w http.ResponseWriter, tmpl *template.Template) (err error) {
-	log.Debug().Interface("page_data", p).Msg("Page data")
-	if p.IsASCII && p.Size < 10000000 {
+	// the page holds the password and delete token hashes, they stay out of
+	// the logs
+	log.Debug().Str("id", p.ID).Str("name", p.Name).Msg("Page data")
+	// limited downloads are not previewed, that would bypass the limit
+	if p.IsASCII && p.Size < 10000000 && !p.Locked && p.MaxDownloads == 0 && !p.Encrypted {
 		log.Debug().Str("page_id", p.ID).Msg("Showing page")
 
-		file, err := os.Open(p.NameOnDisk)
+		gr, err := p.openDecompressed()
 		if err != nil {
 			log.Error().Err(err).Msg("Error opening file")
 			return err
 		}
-		defer file.Close()
-
-		gr, err := gzip.NewReader(file)
-		if err != nil {
-			log.Error().Err(err).Msg("Error creating gzip reader")
-			return err
-		}
 		defer gr.Close()
 
 		buf := new(bytes.Buffer)
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// postUpload uploads a file with the form fields before it and returns the
+// response.
+func (ts *testServer) postUpload(t *testing.T, fields map[string]string, content string) *http.Response {
+	t.Helper()
+	return ts.postFile(t, "file.txt", fields, content)
+}
+
+// postFile is postUpload with the name of the file.
+func (ts *testServer) postFile(t *testing.T, name string, fields map[string]string, content string) *http.Response {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	mw := multipart.NewWriter(buf)
+	for name, value := range fields {
+		mw.WriteField(name, value)
+	}
+	fw, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte(content))
+	mw.Close()
+	resp, err := ts.client.Post(ts.app.URL+"/", mw.FormDataContentType(), buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readResponse(t, resp)
+}
+
+func TestUploadFormFields(t *testing.T) {
+	ts := newTestServer(t, nil)
+	if resp := ts.postUpload(t, map[string]string{"password": "secret"}, "hello"); resp.StatusCode != http.StatusCreated {
+		t.Errorf("upload: got %s, want %d", resp.Status, http.StatusCreated)
+	}
+	// fields are rejected rather than cut off at the limit, whichever they are
+	resp := ts.postUpload(t, map[string]string{"comment": strings.Repeat("a", maxFieldSize+1)}, "hello")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("upload with an oversized field: got %s, want %d", resp.Status, http.StatusBadRequest)
+	}
+}
+
+// uploaded is the answer of the server to an upload.
+type uploaded struct {
+	ID          string `json:"id"`
+	DeleteToken string `json:"delete_token"`
+	SHA256      string `json:"sha256"`
+}
+
+// upload uploads content with the form fields and returns what the server
+// answered, failing unless the upload is stored.
+func (ts *testServer) upload(t *testing.T, fields map[string]string, content string) uploaded {
+	t.Helper()
+	resp := ts.postUpload(t, fields, content)
+	var u uploaded
+	if err := json.NewDecoder(resp.Body).Decode(&u); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload: got %s, %v", resp.Status, err)
+	}
+	return u
+}
+
+// request sends a request with the given headers to path of the server.
+func (ts *testServer) request(t *testing.T, method string, path string, header map[string]string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, ts.app.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readResponse(t, resp)
+}
+
+func TestRangeRequests(t *testing.T) {
+	random := make([]byte, 10000)
+	rand.Read(random)
+	for name, content := range map[string]string{
+		"compressed":   strings.Repeat("0123456789", 1000),
+		"uncompressed": string(random),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ts := newTestServer(t, nil)
+			raw := "/1/" + ts.upload(t, nil, content).ID
+			resp := ts.request(t, http.MethodGet, raw, map[string]string{"Accept-Encoding": "identity"})
+			etag, modified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+			if resp.StatusCode != http.StatusOK || body(t, resp) != content || etag == "" || modified == "" {
+				t.Fatalf("GET: got %s with ETag %q and Last-Modified %q", resp.Status, etag, modified)
+			}
+
+			for _, tt := range []struct {
+				name   string
+				header map[string]string
+				status int
+				want   string
+			}{
+				{"range", map[string]string{"Range": "bytes=10-19"}, http.StatusPartialContent, content[10:20]},
+				{"suffix", map[string]string{"Range": "bytes=-5"}, http.StatusPartialContent, content[len(content)-5:]},
+				{"open end", map[string]string{"Range": "bytes=9990-"}, http.StatusPartialContent, content[9990:]},
+				{"unsatisfiable", map[string]string{"Range": "bytes=20000-"}, http.StatusRequestedRangeNotSatisfiable, ""},
+				{"if-range matches", map[string]string{"Range": "bytes=0-3", "If-Range": etag}, http.StatusPartialContent, content[:4]},
+				{"if-range changed", map[string]string{"Range": "bytes=0-3", "If-Range": `"other"`}, http.StatusOK, content},
+				{"if-none-match", map[string]string{"If-None-Match": etag}, http.StatusNotModified, ""},
+				{"if-none-match changed", map[string]string{"If-None-Match": `"other"`}, http.StatusOK, content},
+				{"if-modified-since", map[string]string{"If-Modified-Since": modified}, http.StatusNotModified, ""},
+			} {
+				tt.header["Accept-Encoding"] = "identity"
+				resp := ts.request(t, http.MethodGet, raw, tt.header)
+				if resp.StatusCode != tt.status {
+					t.Errorf("%s: got %s, want %d", tt.name, resp.Status, tt.status)
+				} else if got := body(t, resp); tt.want != "" && got != tt.want {
+					t.Errorf("%s: got %d bytes, want %d", tt.name, len(got), len(tt.want))
+				}
+			}
+
+			// ranges refer to the uncompressed data, whatever the client accepts
+			resp = ts.request(t, http.MethodGet, raw, map[string]string{"Range": "bytes=100-109", "Accept-Encoding": "gzip, zstd"})
+			if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Content-Encoding") != "" || body(t, resp) != content[100:110] {
+				t.Errorf("range accepting compression: got %s encoded with %q", resp.Status, resp.Header.Get("Content-Encoding"))
+			}
+			if got := resp.Header.Get("Content-Range"); got != "bytes 100-109/10000" {
+				t.Errorf("Content-Range: got %q", got)
+			}
+		})
+	}
+}
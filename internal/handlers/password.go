@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/tuilakhanh/webshare/internal/pkg"
+	"github.com/tuilakhanh/webshare/internal/storage"
+)
+
+// Password protected shares. Entering the password on the share page sets a
+// signed cookie that unlocks the share for UnlockDuration. API clients can
+// send the password in the X-Share-Password header instead.
+
+const unlockCookiePrefix = "webshare_unlock_"
+
+const (
+	maxPasswordAttempts   = 5
+	passwordAttemptWindow = 15 * time.Minute
+)
+
+// maxPasswordLen is the most bcrypt takes into account.
+const maxPasswordLen = 72
+
+// errPasswordTooLong is returned for passwords bcrypt would cut off.
+var errPasswordTooLong = fmt.Errorf("password is longer than %d bytes", maxPasswordLen)
+
+// passwordTooLongMessage is what uploaders are told about it.
+var passwordTooLongMessage = fmt.Sprintf("The password must be at most %d bytes.", maxPasswordLen)
+
+// hashPassword returns the hash stored for a share password.
+func hashPassword(password string) (string, error) {
+	if len(password) > maxPasswordLen {
+		return "", errPasswordTooLong
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// passwordLimiter limits the wrong password attempts per ID.
+type passwordLimiter struct {
+	mu       sync.Mutex
+	attempts map[string]*passwordAttempts
+}
+
+type passwordAttempts struct {
+	count int
+	since time.Time
+}
+
+func newPasswordLimiter() *passwordLimiter {
+	return &passwordLimiter{attempts: make(map[string]*passwordAttempts)}
+}
+
+// allow reports whether another attempt on id may be made.
+func (l *passwordLimiter) allow(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, a := range l.attempts {
+		if time.Since(a.since) > passwordAttemptWindow {
+			delete(l.attempts, key)
+		}
+	}
+	a, ok := l.attempts[id]
+	return !ok || a.count < maxPasswordAttempts
+}
+
+// fail records a wrong password for id.
+func (l *passwordLimiter) fail(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	a, ok := l.attempts[id]
+	if !ok {
+		a = &passwordAttempts{since: time.Now()}
+		l.attempts[id] = a
+	}
+	a.count++
+}
+
+// checkPassword compares password with the one of the page, counting wrong
+// attempts against the rate limit.
+func (s *Server) checkPassword(page *Page, password string) error {
+	if !s.passwordLimiter.allow(page.ID) {
+		log.Warn().Str("id", page.ID).Msg("Too many wrong passwords")
+		return errTooManyAttempts
+	}
+	if bcrypt.CompareHashAndPassword([]byte(page.PasswordHash), []byte(password)) != nil {
+		s.passwordLimiter.fail(page.ID)
+		return errWrongPassword
+	}
+	return nil
+}
+
+var (
+	errWrongPassword   = errors.New("Wrong password.")
+	errTooManyAttempts = errors.New("Too many wrong passwords, try again later.")
+)
+
+// unlockKey is the key the unlock cookies of page are signed with. It
+// includes the password hash, so changing the password locks the share again.
+func (s *Server) unlockKey(page *Page) []byte {
+	return []byte(s.config.Secret + page.PasswordHash)
+}
+
+// isUnlocked reports whether the request may access the page.
+func (s *Server) isUnlocked(c *gin.Context, page *Page) bool {
+	if page.PasswordHash == "" {
+		return true
+	}
+	if password := c.GetHeader("X-Share-Password"); password != "" {
+		return s.checkPassword(page, password) == nil
+	}
+	cookie, err := c.Cookie(unlockCookiePrefix + page.ID)
+	if err != nil {
+		return false
+	}
+	value, ok := pkg.VerifyValue(s.unlockKey(page), cookie)
+	if !ok {
+		return false
+	}
+	id, expires, _ := strings.Cut(value, "|")
+	expiresUnix, err := strconv.ParseInt(expires, 10, 64)
+	return err == nil && id == page.ID && time.Now().Unix() < expiresUnix
+}
+
+// handleUnlock checks the password posted from the share page and sets the
+// unlock cookie.
+func (s *Server) handleUnlock(c *gin.Context) {
+	id := c.Param("id")
+	name := c.Param("name")
+
+	page, err := loadPageInfo(id, *s.config, s.store)
+	if errors.Is(err, storage.ErrNotExist) || (err == nil && name != page.Name) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Data with id '%s' does not exist.", id)})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to access file"})
+		return
+	}
+	if page.PasswordHash == "" {
+		c.Redirect(http.StatusSeeOther, fmt.Sprintf("/%s/%s", page.ID, url.PathEscape(page.Name)))
+		return
+	}
+
+	if err := s.checkPassword(page, c.PostForm("password")); err != nil {
+		page.Locked = true
+		page.Error = err.Error()
+		status := http.StatusUnauthorized
+		if err == errTooManyAttempts {
+			status = http.StatusTooManyRequests
+		}
+		c.Status(status)
+		page.handleShowDataInBrowser(c.Writer, s.indexTemplate)
+		return
+	}
+
+	expires := time.Now().Add(s.config.UnlockDuration)
+	value := pkg.SignValue(s.unlockKey(page), fmt.Sprintf("%s|%d", page.ID, expires.Unix()))
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     unlockCookiePrefix + page.ID,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(s.config.PublicURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	c.Redirect(http.StatusSeeOther, fmt.Sprintf("/%s/%s", page.ID, url.PathEscape(page.Name)))
+}
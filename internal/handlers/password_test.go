@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tuilakhanh/webshare/internal/pkg"
+)
+
+func TestPasswordUnlock(t *testing.T) {
+	ts := newTestServer(t, nil)
+	u := ts.upload(t, map[string]string{"password": "secret"}, "hidden")
+	id, _, _ := strings.Cut(u.ID, "/")
+	raw, share := ts.app.URL+"/1/"+u.ID, "/"+u.ID
+
+	if resp := ts.get(t, raw); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("locked share: got %s, want %d", resp.Status, http.StatusUnauthorized)
+	}
+	header := func(password string) map[string]string {
+		return map[string]string{"X-Share-Password": password}
+	}
+	if resp := ts.request(t, http.MethodGet, "/1/"+u.ID, header("wrong")); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong password in the header: got %s, want %d", resp.Status, http.StatusUnauthorized)
+	}
+	if resp := ts.request(t, http.MethodGet, "/1/"+u.ID, header("secret")); resp.StatusCode != http.StatusOK || body(t, resp) != "hidden" {
+		t.Errorf("password in the header: got %s, want the file", resp.Status)
+	}
+
+	if resp := ts.postForm(t, share, url.Values{"password": {"wrong"}}); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unlock with a wrong password: got %s, want %d", resp.Status, http.StatusUnauthorized)
+	}
+	if resp := ts.get(t, raw); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unlocked by a wrong password: %s", resp.Status)
+	}
+	resp := ts.postForm(t, share, url.Values{"password": {"secret"}})
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("unlock: got %s, want %d", resp.Status, http.StatusSeeOther)
+	}
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == unlockCookiePrefix+id {
+			cookie = c
+		}
+	}
+	if cookie == nil || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("unlock: got cookie %v, want an HttpOnly and SameSite one", cookie)
+	}
+	if resp := ts.get(t, raw); resp.StatusCode != http.StatusOK || body(t, resp) != "hidden" {
+		t.Errorf("unlocked share: got %s, want the file", resp.Status)
+	}
+
+	// the cookie only unlocks the share it was made for, until it expires
+	other := ts.upload(t, map[string]string{"password": "secret"}, "other")
+	otherID, _, _ := strings.Cut(other.ID, "/")
+	page, err := loadPageInfo(id, *ts.server.config, ts.server.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := pkg.SignValue(ts.server.unlockKey(page), fmt.Sprintf("%s|%d", id, time.Now().Add(-time.Minute).Unix()))
+	for name, c := range map[string]*http.Cookie{
+		"copied to another share": {Name: unlockCookiePrefix + otherID, Value: cookie.Value},
+		"tampered":                {Name: unlockCookiePrefix + id, Value: strings.Replace(cookie.Value, "|", "|9", 1)},
+		"expired":                 {Name: unlockCookiePrefix + id, Value: expired},
+	} {
+		path := "/1/" + u.ID
+		if c.Name != unlockCookiePrefix+id {
+			path = "/1/" + other.ID
+		}
+		req, err := http.NewRequest(http.MethodGet, ts.app.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.AddCookie(c)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s cookie: got %s, want %d", name, resp.Status, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestPasswordLimiter(t *testing.T) {
+	ts := newTestServer(t, nil)
+	u := ts.upload(t, map[string]string{"password": "secret"}, "hidden")
+	share := "/" + u.ID
+	for i := range maxPasswordAttempts {
+		if resp := ts.postForm(t, share, url.Values{"password": {"wrong"}}); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: got %s, want %d", i+1, resp.Status, http.StatusUnauthorized)
+		}
+	}
+	// even the right password is refused until the window has passed
+	if resp := ts.postForm(t, share, url.Values{"password": {"secret"}}); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("after %d wrong passwords: got %s, want %d", maxPasswordAttempts, resp.Status, http.StatusTooManyRequests)
+	}
+	if resp := ts.request(t, http.MethodGet, "/1/"+u.ID, map[string]string{"X-Share-Password": "secret"}); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("header after %d wrong passwords: got %s, want %d", maxPasswordAttempts, resp.Status, http.StatusUnauthorized)
+	}
+
+	// other shares are not affected
+	other := ts.upload(t, map[string]string{"password": "secret"}, "other")
+	if resp := ts.postForm(t, "/"+other.ID, url.Values{"password": {"secret"}}); resp.StatusCode != http.StatusSeeOther {
+		t.Errorf("another share: got %s, want %d", resp.Status, http.StatusSeeOther)
+	}
+}
+
+func TestPasswordTooLong(t *testing.T) {
+	ts := newTestServer(t, nil)
+	resp := ts.postUpload(t, map[string]string{"password": strings.Repeat("a", maxPasswordLen+1)}, "hidden")
+	if got := body(t, resp); resp.StatusCode != http.StatusBadRequest || !strings.Contains(got, passwordTooLongMessage) {
+		t.Errorf("upload: got %s %s, want %d", resp.Status, got, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/hako/durafmt"
+)
+
+// PrintRetention writes when each stored file expires, without deleting
+// anything. Files stored before their expiry was recorded are shown with the
+// expiry the current retention options give them.
+func (s *Server) PrintRetention(w io.Writer) error {
+	ids, err := s.store.List("")
+	if err != nil {
+		return err
+	}
+	var pages []*Page
+	for _, id := range ids {
+		if !isFileID(id) {
+			continue
+		}
+		p, err := loadPageInfo(id, *s.config, s.store)
+		if err != nil {
+			fmt.Fprintf(w, "skipping %s: %s\n", id, err)
+			continue
+		}
+		pages = append(pages, p)
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].ExpiresAt.Before(pages[j].ExpiresAt) })
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "EXPIRES\tIN\tFROM\tSIZE\tTYPE\tFILE")
+	for _, p := range pages {
+		in := "expired"
+		if remaining := time.Until(p.ExpiresAt); remaining > 0 {
+			in = durafmt.Parse(remaining.Round(time.Minute)).LimitFirstN(2).String()
+		}
+		from := "stored"
+		if p.legacyExpiry {
+			from = "policy"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			p.ExpiresAt.Local().Format(time.DateTime), in, from,
+			humanize.Bytes(p.Size), p.ContentType, path.Join(p.ID, p.Name))
+	}
+	return tw.Flush()
+}
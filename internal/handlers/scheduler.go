@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// expiryItem is a file waiting in the expiry queue.
+type expiryItem struct {
+	id        string
+	expiresAt time.Time
+	index     int
+}
+
+// expiryQueue is a heap of the files ordered by expiry, soonest first.
+type expiryQueue []*expiryItem
+
+func (q expiryQueue) Len() int           { return len(q) }
+func (q expiryQueue) Less(i, j int) bool { return q[i].expiresAt.Before(q[j].expiresAt) }
+func (q expiryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *expiryQueue) Push(x any) {
+	item := x.(*expiryItem)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *expiryQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return item
+}
+
+// expiryScheduler wakes up exactly when the next file expires, instead of
+// checking all the files periodically.
+type expiryScheduler struct {
+	mu    sync.Mutex
+	queue expiryQueue
+	items map[string]*expiryItem
+	// wake interrupts the wait when the next expiry changed
+	wake chan struct{}
+}
+
+func newExpiryScheduler() *expiryScheduler {
+	return &expiryScheduler{
+		items: make(map[string]*expiryItem),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// schedule sets when the file with the given ID expires.
+func (e *expiryScheduler) schedule(id string, expiresAt time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if item, ok := e.items[id]; ok {
+		item.expiresAt = expiresAt
+		heap.Fix(&e.queue, item.index)
+	} else {
+		item = &expiryItem{id: id, expiresAt: expiresAt}
+		heap.Push(&e.queue, item)
+		e.items[id] = item
+	}
+	if e.queue[0].id == id {
+		e.signal()
+	}
+}
+
+// remove forgets the file with the given ID, after it was deleted.
+func (e *expiryScheduler) remove(id string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if item, ok := e.items[id]; ok {
+		heap.Remove(&e.queue, item.index)
+		delete(e.items, id)
+	}
+}
+
+func (e *expiryScheduler) signal() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// due removes the files that expired from the queue and returns their IDs,
+// along with the time until the next file expires.
+func (e *expiryScheduler) due(now time.Time) (ids []string, next time.Duration, ok bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for len(e.queue) > 0 && !e.queue[0].expiresAt.After(now) {
+		item := heap.Pop(&e.queue).(*expiryItem)
+		delete(e.items, item.id)
+		ids = append(ids, item.id)
+	}
+	if len(e.queue) == 0 {
+		return ids, 0, false
+	}
+	return ids, e.queue[0].expiresAt.Sub(now), true
+}
+
+// run calls expire for every file as soon as it expires, and maintain every
+// interval, until ctx is done.
+func (e *expiryScheduler) run(ctx context.Context, interval time.Duration, expire func(id string), maintain func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			maintain()
+			continue
+		case <-e.wake:
+		case <-timer.C:
+		}
+
+		ids, next, ok := e.due(time.Now())
+		for _, id := range ids {
+			if ctx.Err() != nil {
+				return
+			}
+			expire(id)
+		}
+		timer.Stop()
+		if ok {
+			timer.Reset(next)
+		}
+	}
+}
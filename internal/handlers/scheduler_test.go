@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestExpirySchedulerOrder(t *testing.T) {
+	e := newExpiryScheduler()
+	now := time.Now()
+	e.schedule("c", now.Add(3*time.Second))
+	e.schedule("a", now.Add(time.Second))
+	e.schedule("d", now.Add(4*time.Second))
+	e.schedule("b", now.Add(2*time.Second))
+
+	if ids, next, ok := e.due(now); len(ids) != 0 || next != time.Second || !ok {
+		t.Errorf("due now: got %v, next in %v, %v, want nothing due for a second", ids, next, ok)
+	}
+	ids, next, ok := e.due(now.Add(2500 * time.Millisecond))
+	if !slices.Equal(ids, []string{"a", "b"}) || next != 500*time.Millisecond || !ok {
+		t.Errorf("due: got %v, next in %v, %v, want a and b, then c in 500ms", ids, next, ok)
+	}
+
+	// rescheduling moves a file in the queue, removing drops it
+	e.schedule("c", now.Add(5*time.Second))
+	e.schedule("e", now.Add(time.Second))
+	e.remove("d")
+	e.remove("missing")
+	ids, _, ok = e.due(now.Add(10 * time.Second))
+	if !slices.Equal(ids, []string{"e", "c"}) || ok {
+		t.Errorf("due: got %v, %v, want e and c and nothing left", ids, ok)
+	}
+}
+
+func TestExpirySchedulerRun(t *testing.T) {
+	e := newExpiryScheduler()
+	ctx, cancel := context.WithCancel(context.Background())
+	expired := make(chan string, 10)
+	done := make(chan struct{})
+	go func() {
+		e.run(ctx, time.Hour, func(id string) { expired <- id }, func() {})
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// the scheduler waits for the later file, an earlier one wakes it up
+	e.schedule("later", time.Now().Add(time.Hour))
+	e.schedule("soon", time.Now().Add(20*time.Millisecond))
+	e.schedule("now", time.Now())
+	for _, want := range []string{"now", "soon"} {
+		select {
+		case id := <-expired:
+			if id != want {
+				t.Errorf("expired %q, want %q", id, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q did not expire", want)
+		}
+	}
+	select {
+	case id := <-expired:
+		t.Errorf("expired %q too early", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -2,16 +2,20 @@ package handlers
 
 import (
 	"bytes"
-	"compress/gzip"
+	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -22,81 +26,228 @@ import (
 
 	"github.com/tuilakhanh/webshare/internal/config"
 	"github.com/tuilakhanh/webshare/internal/pkg"
+	"github.com/tuilakhanh/webshare/internal/storage"
 )
 
 //go:embed static/*
 var content embed.FS
 
 type Server struct {
-	config        *config.Config
-	indexTemplate *template.Template
+	config          *config.Config
+	store           storage.Storage
+	indexTemplate   *template.Template
+	passwordLimiter *passwordLimiter
+	downloads       *downloadCounter
+	expiry          *expiryScheduler
+	// oidc is nil unless signing in with OpenID Connect is configured
+	oidc *oidcLogin
+	// reserved holds the bytes of the uploads of every identity that are
+	// being stored, they count against its quota until they are
+	reservedMu sync.Mutex
+	reserved   map[string]int64
 }
 
-func NewServer(cfg *config.Config) *Server {
+func NewServer(cfg *config.Config, store storage.Storage) *Server {
 	tmpl, err := template.ParseFS(content, "static/index.html")
 	if err != nil {
 		log.Fatal().Err(err).Msg("Error parsing index template")
 	}
 	return &Server{
-		config:        cfg,
-		indexTemplate: tmpl,
+		config:          cfg,
+		store:           store,
+		indexTemplate:   tmpl,
+		passwordLimiter: newPasswordLimiter(),
+		downloads:       newDownloadCounter(store),
+		expiry:          newExpiryScheduler(),
+		oidc:            newOIDCLogin(cfg),
+		reserved:        make(map[string]int64),
 	}
 }
 
-func (s *Server) Start() error {
-	go func() {
-		s.deleteOld(true) // Initial cleanup on startup
-		pkg.TrimContent(*s.config)
-		for {
-			time.Sleep(30 * time.Minute)
-			s.deleteOld()
-			pkg.TrimContent(*s.config)
-		}
-	}()
+// maintenanceInterval is how often expired resumable uploads are removed and
+// the storage is trimmed.
+const maintenanceInterval = 30 * time.Minute
+
+// shutdownTimeout is how long requests in progress may take to finish when
+// the server is stopped.
+const shutdownTimeout = 10 * time.Second
+
+// Start serves until ctx is done, then lets the requests in progress and the
+// expiry loop finish.
+func (s *Server) Start(ctx context.Context) error {
 	router := gin.Default()
+	// the address of the client is that of the connection unless it comes
+	// from a trusted proxy, anyone could send X-Forwarded-For
+	if err := router.SetTrustedProxies(splitList(s.config.TrustedProxies)); err != nil {
+		return err
+	}
 	router.Use(logger.SetLogger())
 	s.SetupRoutes(router)
-	return router.Run(":" + s.config.Port)
+
+	s.removeTempFiles() // Initial cleanup on startup
+	s.scheduleExpiries()
+	s.maintain()
+	expiryDone := make(chan struct{})
+	go func() {
+		defer close(expiryDone)
+		s.expiry.run(ctx, maintenanceInterval, s.expire, s.maintain)
+	}()
+
+	srv := &http.Server{Addr: ":" + s.config.Port, Handler: router}
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		log.Info().Msg("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Error().Err(err).Msg("Error shutting down")
+		}
+	}()
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	// ListenAndServe returns as soon as the shutdown begins
+	<-shutdownDone
+	<-expiryDone
+	s.downloads.flush()
+	return nil
+}
+
+// maintain does the cleanup that is not tied to the expiry of a file, and
+// stores the download counts.
+func (s *Server) maintain() {
+	s.downloads.flush()
+	s.deleteExpiredUploads()
+	TrimContent(*s.config, s.store)
+	collectBlobs(s.store)
 }
 
 func (s *Server) SetupRoutes(router *gin.Engine) { // Method on your server struct
+	router.Use(s.userContentMiddleware)
 	router.GET("/", s.handleHome)
-	router.GET("/delete/:id", s.handleDelete)
+	if s.config.AllowGetDelete {
+		router.GET("/delete/:id", s.handleDelete)
+	}
+	router.POST("/delete/:id", s.handleDeleteForm)
+	router.DELETE("/:id", s.handleDeleteWithToken)
 	router.GET("/exists/:id/:name", s.handleExists)
 	router.GET("/static/*filepath", s.handleStatic)
 	router.GET("/1/:id/:name", s.handleRawData) // Assuming raw data doesn't need decompression
-	router.GET("/:id/:name", s.handleShowData)  // Showing data in the browser
-	router.POST("/", s.handlePost)
+	router.HEAD("/1/:id/:name", s.handleRawData)
+	router.GET("/:id/:name", s.handleShowData) // Showing data in the browser
+	router.POST("/:id/:name", s.handleUnlock)  // Password of protected data
+	router.POST("/", s.authenticate, s.requireUploader, s.handlePost)
+	router.GET("/my", s.handleMyUploads)
+	router.GET("/api/uploads", s.authenticate, s.handleUploadsAPI)
+	if s.oidc != nil {
+		router.GET("/auth/login", s.handleLogin)
+		router.GET("/auth/callback", s.handleLoginCallback)
+	}
+	if s.config.Accounts {
+		router.POST("/auth/password", s.handlePasswordLogin)
+	}
+	router.POST("/auth/logout", s.handleLogout)
+
+	// resumable uploads (tus protocol)
+	tus := router.Group("/files", s.tusMiddleware)
+	tus.OPTIONS("/", s.handleTusOptions)
+	tus.OPTIONS("/:uid", s.handleTusOptions)
+	tus.Use(s.authenticate, s.requireUploader)
+	tus.POST("/", s.handleTusCreate)
+	tus.HEAD("/:uid", s.handleTusHead)
+	tus.PATCH("/:uid", s.handleTusPatch)
+	tus.DELETE("/:uid", s.handleTusDelete)
+	tus.POST("/:uid", s.handleTusOverride)
 }
 
 func (s *Server) handleHome(c *gin.Context) {
-	p := NewPage(*s.config)
+	p := s.homePage(c)
 	p.handleGetHome(c.Writer, s.indexTemplate)
 }
 
 func (s *Server) handleDelete(c *gin.Context) {
-	// GET /delete/ID will delete the ID
+	// GET /delete/ID will delete the ID without asking for the delete token.
+	// Only kept for old instances, see the allow-get-delete option.
 	id := c.Param("id")
-	_, errStat := os.Stat(path.Join(s.config.ContentDirectory, id))
-	if errStat != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Data with id '%s' does not exist.", id)})
+	if err := deleteFile(s.store, *s.config, id); err != nil {
+		if errors.Is(err, storage.ErrNotExist) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Data with id '%s' does not exist.", id)})
+		} else {
+			log.Error().Err(err).Str("id", id).Msg("Error deleting file")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file"})
+		}
 		return
 	}
-	os.RemoveAll(path.Join(s.config.ContentDirectory, id))
-	p := NewPage(*s.config)
+	s.expiry.remove(id)
+	p := s.homePage(c)
 	p.Error = fmt.Sprintf("Removed %s.", id)
 	p.handleGetHome(c.Writer, s.indexTemplate)
 }
 
+// handleDeleteWithToken deletes the ID if the request carries its delete
+// token, either in the X-Delete-Token header or in the token query parameter.
+func (s *Server) handleDeleteWithToken(c *gin.Context) {
+	id := c.Param("id")
+	token := c.GetHeader("X-Delete-Token")
+	if token == "" {
+		token = c.Query("token")
+	}
+	status, err := s.deleteWithToken(id, token)
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(status, gin.H{"message": fmt.Sprintf("Removed %s.", id)})
+}
+
+// handleDeleteForm is the browser flow of handleDeleteWithToken, posted by
+// the delete button of the share page.
+func (s *Server) handleDeleteForm(c *gin.Context) {
+	id := c.Param("id")
+	_, err := s.deleteWithToken(id, c.PostForm("token"))
+	p := s.homePage(c)
+	if err != nil {
+		p.Error = err.Error()
+	} else {
+		p.Error = fmt.Sprintf("Removed %s.", id)
+	}
+	p.handleGetHome(c.Writer, s.indexTemplate)
+}
+
+// deleteWithToken deletes the ID if token is its delete token. It returns
+// the HTTP status to answer with.
+func (s *Server) deleteWithToken(id string, token string) (int, error) {
+	page, err := loadPageInfo(id, *s.config, s.store)
+	if errors.Is(err, storage.ErrNotExist) {
+		return http.StatusNotFound, fmt.Errorf("Data with id '%s' does not exist.", id)
+	} else if err != nil {
+		log.Error().Err(err).Str("id", id).Msg("Error loading page info")
+		return http.StatusInternalServerError, errors.New("Failed to access file")
+	}
+	if !pkg.SecretMatches(token, page.DeleteTokenHash) {
+		log.Debug().Str("id", id).Msg("Wrong delete token")
+		return http.StatusForbidden, errors.New("Wrong delete token.")
+	}
+	if err := deletePage(s.store, page); err != nil {
+		log.Error().Err(err).Str("id", id).Msg("Error deleting file")
+		return http.StatusInternalServerError, errors.New("Failed to delete file")
+	}
+	s.expiry.remove(id)
+	log.Info().Str("id", id).Msg("Deleted file on request of its owner")
+	return http.StatusOK, nil
+}
+
 func (s *Server) handleExists(c *gin.Context) {
 	id := filepath.Clean(c.Param("id"))
 	name := filepath.Clean(c.Param("name"))
 
-	// Construct the full file path
-	filePath := path.Join(s.config.ContentDirectory, id, name)
-
-	// Check for existence directly using os.Stat
-	_, err := os.Stat(filePath)
+	// The data may be shared with other IDs, so check the meta information
+	page, err := loadPageInfo(id, *s.config, s.store)
+	if err != nil && !errors.Is(err, storage.ErrNotExist) {
+		log.Error().Err(err).Str("id", id).Msg("Error checking file existence")
+	}
 
 	response := gin.H{
 		"exists": "no",
@@ -104,8 +255,11 @@ func (s *Server) handleExists(c *gin.Context) {
 		"name":   name,
 	}
 
-	if !os.IsNotExist(err) {
+	if err == nil && page.Name == name {
 		response["exists"] = "yes"
+		if !s.isUnlocked(c, page) {
+			response["exists"] = "locked"
+		}
 	}
 
 	// Log the response
@@ -115,7 +269,7 @@ func (s *Server) handleExists(c *gin.Context) {
 }
 
 func (s *Server) handleStatic(c *gin.Context) {
-	page := NewPage(*s.config)
+	page := NewPage(*s.config, s.store)
 	page.NameOnDisk = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(c.Request.URL.Path[1:])), "/") + ".gz"
 	var b []byte
 	b, err := content.ReadFile(page.NameOnDisk)
@@ -146,33 +300,96 @@ func (s *Server) handleRawData(c *gin.Context) {
 	id := c.Param("id")
 	name := c.Param("name")
 
-	// Construct the file path
-	filePath := path.Join(s.config.ContentDirectory, id)
-
-	// Check if file exists
-	if _, err := os.Stat(filePath); err != nil {
-		if os.IsNotExist(err) { // Handle specific case of missing file
-			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Data with id '%s' does not exist.", id)})
-		} else { // Handle other errors
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to access file"})
-		}
-		return
-	}
-
 	// Load page info and handle data
-	page, err := loadPageInfo(id, *s.config)
-	if err != nil {
+	page, err := loadPageInfo(id, *s.config, s.store)
+	if errors.Is(err, storage.ErrNotExist) { // Handle specific case of missing file
+		s.handleMissing(c, id)
+		return
+	} else if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Data with id '%s' does not exist.", id)})
 		return
 	}
 
 	// Ensure the requested file matches the loaded page info
 	if name == "" || name != page.Name {
-		c.Redirect(http.StatusNotFound, fmt.Sprintf("/%s/%s", page.ID, page.Name))
+		c.Redirect(http.StatusNotFound, fmt.Sprintf("/%s/%s", page.ID, url.PathEscape(page.Name)))
+		return
+	}
+
+	if !s.isUnlocked(c, page) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": fmt.Sprintf("Data with id '%s' is password protected.", id)})
 		return
 	}
 
-	page.handleGetData(c.Writer, false)
+	if atUserContent(*s.config, page) && !isUserContentHost(*s.config, c.Request) {
+		c.Redirect(http.StatusTemporaryRedirect, page.Link)
+		return
+	}
+
+	if page.MaxDownloads > 0 {
+		s.handleLimitedData(c, page)
+		return
+	}
+	if c.Request.Method != http.MethodGet {
+		page.handleGetData(c.Writer, c.Request)
+		return
+	}
+	recordAccess(s.store, page.ID)
+	w := &downloadWriter{ResponseWriter: c.Writer}
+	page.handleGetData(w, c.Request)
+	// a download is counted once when it starts, resuming it is free
+	if w.status == http.StatusOK || (w.status == http.StatusPartialContent && strings.HasPrefix(c.GetHeader("Range"), "bytes=0-")) {
+		s.downloads.downloaded(page)
+	}
+}
+
+// handleMissing answers requests for an ID that is not stored, telling why
+// if the file was evicted.
+func (s *Server) handleMissing(c *gin.Context, id string) {
+	if t, err := loadTombstone(id, s.store); err == nil {
+		c.JSON(http.StatusGone, gin.H{"error": fmt.Sprintf("Data with id '%s' was removed: %s.", id, t.Reason)})
+		return
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Data with id '%s' does not exist.", id)})
+}
+
+// handleLimitedData sends the data of a share with a download limit. Every
+// GET is a complete download: ranges and conditional requests are not
+// supported, as they could not be counted sensibly. HEAD requests are free.
+func (s *Server) handleLimitedData(c *gin.Context, page *Page) {
+	for _, header := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+		c.Request.Header.Del(header)
+	}
+	c.Header("Cache-Control", "no-store")
+	gone := gin.H{"error": fmt.Sprintf("Data with id '%s' has no downloads left.", page.ID)}
+
+	if c.Request.Method == http.MethodHead {
+		remaining, err := s.downloads.remaining(page)
+		if err != nil {
+			log.Error().Err(err).Str("id", page.ID).Msg("Error reading download counter")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if remaining <= 0 {
+			c.AbortWithStatus(http.StatusGone)
+			return
+		}
+		c.Header("Webshare-Downloads-Remaining", strconv.Itoa(remaining))
+		page.handleGetData(c.Writer, c.Request)
+		return
+	}
+
+	if err := s.downloads.take(page); errors.Is(err, errNoDownloadsLeft) {
+		c.JSON(http.StatusGone, gone)
+		return
+	} else if err != nil {
+		log.Error().Err(err).Str("id", page.ID).Msg("Error taking download")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to access file"})
+		return
+	}
+	w := &downloadWriter{ResponseWriter: c.Writer}
+	err := page.handleGetData(w, c.Request)
+	s.downloads.finish(page, err == nil && w.complete() && c.Request.Context().Err() == nil)
 }
 
 func (s *Server) handleShowData(c *gin.Context) {
@@ -180,8 +397,11 @@ func (s *Server) handleShowData(c *gin.Context) {
 	name := c.Param("name")
 
 	// Load page info and handle potential errors
-	page, err := loadPageInfo(id, *s.config)
-	if err != nil {
+	page, err := loadPageInfo(id, *s.config, s.store)
+	if errors.Is(err, storage.ErrNotExist) {
+		s.handleMissing(c, id)
+		return
+	} else if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Data with id '%s' does not exist.", id)})
 		return
 	}
@@ -192,99 +412,184 @@ func (s *Server) handleShowData(c *gin.Context) {
 		return
 	}
 
+	page.Locked = !s.isUnlocked(c, page)
+	if page.MaxDownloads > 0 {
+		page.DownloadsRemaining, err = s.downloads.remaining(page)
+		if err != nil {
+			log.Error().Err(err).Str("id", id).Msg("Error reading download counter")
+		}
+	}
+
 	page.handleShowDataInBrowser(c.Writer, s.indexTemplate) // Show data in browser
 }
 
 func (s *Server) handlePost(c *gin.Context) {
-	page := NewPage(*s.config)
-	err := page.handlePost(c)
-
+	maxBytes := s.config.MaxBytesPerFile
+	tooLarge := fmt.Sprintf("Upload exceeds max file size: %s.", s.config.MaxBytesPerFileHuman)
+	identity := uploader(c)
+	remaining, limited, err := s.remainingQuota(identity)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		log.Error().Err(err).Str("uploader", identity).Msg("Error checking storage quota")
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error processing file"})
+		return
 	}
-}
-
-func loadPageInfo(id string, config config.Config) (p *Page, err error) {
-	p = NewPage(config)
-	f, err := os.Open(path.Join(config.ContentDirectory, id, id+".json.gz"))
-	if err != nil {
+	if limited && remaining < maxBytes {
+		maxBytes = remaining
+		tooLarge = quotaMessage(remaining)
+	}
+	if maxBytes <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": tooLarge})
 		return
 	}
-	defer f.Close()
+	if limited {
+		// the file is no larger than the request, only that much is held
+		// back from the quota while it is stored
+		if n := c.Request.ContentLength; n > 0 && n < maxBytes {
+			maxBytes = n
+		}
+		release, err := s.reserveQuota(identity, maxBytes)
+		var quotaErr *quotaError
+		if errors.As(err, &quotaErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		} else if err != nil {
+			log.Error().Err(err).Str("uploader", identity).Msg("Error checking storage quota")
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Error processing file"})
+			return
+		}
+		defer release()
+	}
 
-	w, err := gzip.NewReader(f)
-	if err != nil {
-		return nil, err
+	page := NewPage(*s.config, s.store)
+	stored, err := page.handlePost(c, maxBytes, tooLarge)
+
+	// handlePost answers most errors itself
+	if err != nil && !c.Writer.Written() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+	if stored != nil {
+		s.expiry.schedule(stored.ID, stored.ExpiresAt)
 	}
-	defer w.Close()
+}
 
-	err = json.NewDecoder(w).Decode(&p)
-	if err != nil {
+func loadPageInfo(id string, config config.Config, store storage.Storage) (p *Page, err error) {
+	p = NewPage(config, store)
+	if idx, ok := store.(*Index); ok {
+		data, err := idx.Meta(id)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &p); err != nil {
+			return nil, err
+		}
+	} else if err := readGzippedJSON(p, metaKey(id), store); err != nil {
 		return nil, err
 	}
 
-	p.NameOnDisk = path.Join(config.ContentDirectory, p.ID, p.Name)
-	p.TimeToDeletion = (time.Duration(config.MinutesPerGigabyte) * time.Minute) * time.Duration(1000000000/p.Size)
+	if p.DisplayName == "" {
+		p.DisplayName = p.Name
+	}
+	p.Link = rawLink(config, p)
+	p.NameOnDisk = path.Join(p.ID, p.Name)
+	if p.Blob != "" {
+		p.NameOnDisk = blobKey(p.Blob)
+		if p.SHA256 == "" {
+			// blobs are named after the SHA-256 of their data, unless the
+			// names are encrypted, which only files that keep it have
+			p.SHA256, _, _ = strings.Cut(p.Blob, ".")
+		}
+	}
+	if p.ExpiresAt.IsZero() {
+		// metadata written before the expiry was stored
+		policy, err := pkg.NewRetentionPolicy(config)
+		if err != nil {
+			return nil, err
+		}
+		p.ExpiresAt = p.Modified.Add(policy.Lifetime(p.ContentType, p.Size))
+		p.legacyExpiry = true
+	}
+	p.TimeToDeletion = time.Until(p.ExpiresAt).Round(time.Minute)
 	p.TimeToDeletionHuman = durafmt.Parse(p.TimeToDeletion).String()
 	p.ModifiedHuman = humanize.Time(p.Modified)
 	return
 }
 
-// deleteOld deletes old files from the content directory.
-func (s *Server) deleteOld(removeTempFiles ...bool) {
-	dirSize, _, err := pkg.DirSize(s.config.ContentDirectory)
-	if err != nil {
-		log.Error().Err(err).Msg("Error getting directory size")
-		return
-	}
-
-	files, err := os.ReadDir(s.config.ContentDirectory)
+// scheduleExpiries loads the expiry of every stored file into the expiry
+// queue, files that expired already are deleted right away.
+func (s *Server) scheduleExpiries() {
+	ids, err := s.store.List("")
 	if err != nil {
 		log.Error().Err(err).Msg("Error reading directory")
 		return
 	}
+	log.Debug().Int("num_files", len(ids)).Msg("Scheduling file expiry")
 
-	log.Debug().Int("num_files", len(files)).
-		Str("total_size", humanize.Bytes(uint64(dirSize))).
-		Msg("Checking for old files")
-
-	for _, f := range files {
-		if strings.HasPrefix(f.Name(), "upload_") {
-			if len(removeTempFiles) > 0 && removeTempFiles[0] {
-				err := os.Remove(path.Join(s.config.ContentDirectory, f.Name()))
-				if err != nil {
-					log.Error().Err(err).Str("filename", f.Name()).Msg("Error removing temp file")
-				}
-			}
+	for _, id := range ids {
+		if !isFileID(id) {
 			continue
 		}
-
-		_, id := filepath.Split(f.Name())
-		p, err := loadPageInfo(id, *s.config) // Pass config to loadPageInfo
+		p, err := loadPageInfo(id, *s.config, s.store)
+		if errors.Is(err, storage.ErrNotExist) {
+			if t, err := loadTombstone(id, s.store); err == nil {
+				s.expiry.schedule(id, t.ExpiresAt)
+				continue
+			}
+		}
 		if err != nil {
 			log.Debug().Err(err).Str("id", id).Msg("Skipping file: error loading page info")
 			continue
 		}
+		s.expiry.schedule(p.ID, p.ExpiresAt)
+	}
+}
 
-		age := time.Since(p.Modified)
-		if age < p.TimeToDeletion {
-			log.Debug().
-				Str("id", id).
-				Dur("age", age).
-				Dur("time_to_deletion", p.TimeToDeletion).
-				Msg("Skipping file: not old enough")
-			continue
+// expire deletes the file with the given ID if it expired. The meta
+// information is read again, so files that were deleted in the meantime are
+// skipped.
+func (s *Server) expire(id string) {
+	p, err := loadPageInfo(id, *s.config, s.store)
+	if errors.Is(err, storage.ErrNotExist) {
+		// evicted files leave a tombstone until they would have expired
+		if t, err := loadTombstone(id, s.store); err == nil && !time.Now().Before(t.ExpiresAt) {
+			log.Debug().Str("id", id).Msg("Deleting tombstone")
+			s.store.Delete(id)
 		}
+		return
+	} else if err != nil {
+		log.Error().Err(err).Str("id", id).Msg("Error loading page info")
+		return
+	}
+	if time.Now().Before(p.ExpiresAt) {
+		s.expiry.schedule(p.ID, p.ExpiresAt)
+		return
+	}
+
+	log.Info().
+		Str("id", p.ID).
+		Str("size", p.SizeHuman).
+		Time("modified", p.Modified).
+		Msg("Deleting old file")
 
-		log.Info().
-			Str("id", p.ID).
-			Str("size", p.SizeHuman).
-			Time("modified", p.Modified).
-			Msg("Deleting old file")
+	if err := deletePage(s.store, p); err != nil {
+		log.Error().Err(err).Str("id", p.ID).Msg("Error deleting file")
+	}
+}
 
-		err = os.RemoveAll(path.Join(s.config.ContentDirectory, p.ID))
+// removeTempFiles removes the leftovers of interrupted uploads. Uploads are
+// always staged in the local content directory, whatever the storage backend.
+func (s *Server) removeTempFiles() {
+	files, err := os.ReadDir(s.config.ContentDirectory)
+	if err != nil {
+		log.Error().Err(err).Msg("Error reading directory")
+		return
+	}
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name(), "upload_") {
+			continue
+		}
+		err := os.Remove(path.Join(s.config.ContentDirectory, f.Name()))
 		if err != nil {
-			log.Error().Err(err).Str("id", p.ID).Msg("Error deleting file")
+			log.Error().Err(err).Str("filename", f.Name()).Msg("Error removing temp file")
 		}
 	}
 }
@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/tuilakhanh/webshare/internal/config"
+	"github.com/tuilakhanh/webshare/internal/pkg"
+	"github.com/tuilakhanh/webshare/internal/storage"
+)
+
+// testServer is a server on in-memory storage along with a browser for it.
+type testServer struct {
+	server *Server
+	app    *httptest.Server
+	client *http.Client
+}
+
+// newTestServer starts a server with the config that configure fills in.
+// The storage is kept in memory, with an index if IndexFile is set.
+func newTestServer(t *testing.T, configure func(*config.Config)) *testServer {
+	t.Helper()
+	cfg := &config.Config{
+		UploadDirectory:      t.TempDir(),
+		UploadExpiry:         time.Hour,
+		MaxBytesTotal:        1 << 30,
+		MaxBytesPerFile:      1 << 20,
+		MaxBytesPerFileHuman: "1 MB",
+		Eviction:             "largest",
+		MinutesPerGigabyte:   60,
+		RetentionCurve:       "inverse",
+		MaxRetention:         24 * time.Hour,
+		IDAlphabet:           "base58",
+		IDLength:             8,
+		Codec:                "gzip",
+		CompressionThreshold: 0.9,
+		Secret:               "test",
+		SessionDuration:      time.Hour,
+		UnlockDuration:       time.Hour,
+		OIDCGroupsClaim:      "groups",
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+	var store storage.Storage = storage.NewMemory()
+	if cfg.IndexFile != "" {
+		idx, err := OpenIndex(cfg.IndexFile, store, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { idx.Close() })
+		store = idx
+	}
+	s := NewServer(cfg, store)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	s.SetupRoutes(router)
+	app := httptest.NewServer(router)
+	t.Cleanup(app.Close)
+	cfg.PublicURL = app.URL
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{
+		Jar: jar,
+		// every redirect is followed by hand, to check or tamper with it
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	return &testServer{server: s, app: app, client: client}
+}
+
+// get requests u and returns the response with the body read into it.
+func (ts *testServer) get(t *testing.T, u string) *http.Response {
+	t.Helper()
+	resp, err := ts.client.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readResponse(t, resp)
+}
+
+// postForm posts form to path of the server.
+func (ts *testServer) postForm(t *testing.T, path string, form map[string][]string) *http.Response {
+	t.Helper()
+	resp, err := ts.client.PostForm(ts.app.URL+path, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readResponse(t, resp)
+}
+
+func readResponse(t *testing.T, resp *http.Response) *http.Response {
+	t.Helper()
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body = io.NopCloser(strings.NewReader(string(b)))
+	return resp
+}
+
+// signedIn reports whether the browser holds a session, checked with the
+// uploads API, which only answers signed in users.
+func (ts *testServer) signedIn(t *testing.T) bool {
+	t.Helper()
+	return ts.get(t, ts.app.URL+"/api/uploads").StatusCode == http.StatusOK
+}
+
+func body(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestDeleteTokens(t *testing.T) {
+	ts := newTestServer(t, nil)
+	u := ts.upload(t, nil, "delete me")
+	id, _, _ := strings.Cut(u.ID, "/")
+
+	// only the hash of the token is stored
+	page, err := loadPageInfo(id, *ts.server.config, ts.server.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.DeleteToken == "" || page.DeleteTokenHash != pkg.HashSecret(u.DeleteToken) {
+		t.Errorf("stored %q for the token %q, want its hash", page.DeleteTokenHash, u.DeleteToken)
+	}
+	var meta map[string]any
+	if err := readGzippedJSON(&meta, metaKey(id), ts.server.store); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := json.Marshal(meta); strings.Contains(string(b), u.DeleteToken) {
+		t.Error("the delete token is stored in the meta information")
+	}
+
+	for _, tt := range []struct {
+		name   string
+		method string
+		path   string
+		header map[string]string
+		status int
+	}{
+		{"no token", http.MethodDelete, "/" + id, nil, http.StatusForbidden},
+		{"wrong token", http.MethodDelete, "/" + id, map[string]string{"X-Delete-Token": "wrong"}, http.StatusForbidden},
+		{"hash as token", http.MethodDelete, "/" + id, map[string]string{"X-Delete-Token": page.DeleteTokenHash}, http.StatusForbidden},
+		{"old route", http.MethodGet, "/delete/" + id, nil, http.StatusNotFound},
+		{"unknown ID", http.MethodDelete, "/missing?token=" + u.DeleteToken, nil, http.StatusNotFound},
+	} {
+		if resp := ts.request(t, tt.method, tt.path, tt.header); resp.StatusCode != tt.status {
+			t.Errorf("%s: got %s, want %d", tt.name, resp.Status, tt.status)
+		}
+	}
+	if resp := ts.get(t, ts.app.URL+"/1/"+u.ID); resp.StatusCode != http.StatusOK {
+		t.Fatalf("the file is gone without the delete token: %s", resp.Status)
+	}
+
+	resp := ts.request(t, http.MethodDelete, "/"+id, map[string]string{"X-Delete-Token": u.DeleteToken})
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("delete: got %s, want %d", resp.Status, http.StatusOK)
+	}
+	if resp := ts.get(t, ts.app.URL+"/1/"+u.ID); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("the file is still there after deleting it: %s", resp.Status)
+	}
+
+	// the token can also be sent in the query and by the form of the page
+	u = ts.upload(t, nil, "delete me too")
+	id, _, _ = strings.Cut(u.ID, "/")
+	if resp := ts.request(t, http.MethodDelete, "/"+id+"?token="+u.DeleteToken, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("delete with the query: got %s, want %d", resp.Status, http.StatusOK)
+	}
+	u = ts.upload(t, nil, "and me")
+	id, _, _ = strings.Cut(u.ID, "/")
+	ts.postForm(t, "/delete/"+id, map[string][]string{"token": {u.DeleteToken}})
+	if resp := ts.get(t, ts.app.URL+"/1/"+u.ID); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("the file is still there after deleting it with the form: %s", resp.Status)
+	}
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/tuilakhanh/webshare/internal/pkg"
+)
+
+// Sessions of the web interface are kept in a signed cookie holding the
+// identity of the user, user:<name> for a local account or oidc:<email> for
+// a user signed in with OpenID Connect. The server keeps no state of its own.
+const sessionCookie = "webshare_session"
+
+// session is what the session cookie holds, as base64 encoded JSON.
+type session struct {
+	Expires  int64  `json:"exp"`
+	Identity string `json:"id"`
+	// Groups are those of a user signed in with OpenID Connect, the session
+	// ends once neither they nor the email address are allowed anymore
+	Groups []string `json:"groups,omitempty"`
+	// PasswordGeneration is that of a local account at the sign in
+	PasswordGeneration int `json:"pw,omitempty"`
+}
+
+// sessionKey is the key the session cookies, and the login cookies of
+// OpenID Connect, are signed with.
+func (s *Server) sessionKey() []byte {
+	return []byte(s.config.Secret + "session")
+}
+
+// signInEnabled reports whether users can sign in to the web interface.
+func (s *Server) signInEnabled() bool {
+	return s.oidc != nil || s.config.Accounts
+}
+
+// startSession signs the browser in with sess, which expires after the
+// session duration.
+func (s *Server) startSession(c *gin.Context, sess session) {
+	expires := time.Now().Add(s.config.SessionDuration)
+	sess.Expires = expires.Unix()
+	value, err := json.Marshal(sess)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	s.setCookie(c, sessionCookie, pkg.SignValue(s.sessionKey(), base64.RawURLEncoding.EncodeToString(value)), expires)
+}
+
+// sessionIdentity returns the identity of the user signed in to the web
+// interface, empty if there is none. Sessions of deleted accounts or ones
+// whose password changed, and of users of OpenID Connect the config no
+// longer allows in, end right away.
+func (s *Server) sessionIdentity(c *gin.Context) string {
+	if !s.signInEnabled() {
+		return ""
+	}
+	cookie, err := c.Cookie(sessionCookie)
+	if err != nil {
+		return ""
+	}
+	value, ok := pkg.VerifyValue(s.sessionKey(), cookie)
+	if !ok {
+		return ""
+	}
+	var sess session
+	if b, err := base64.RawURLEncoding.DecodeString(value); err != nil || json.Unmarshal(b, &sess) != nil {
+		return ""
+	}
+	if time.Now().Unix() >= sess.Expires {
+		return ""
+	}
+	kind, name, _ := strings.Cut(sess.Identity, ":")
+	switch kind {
+	case "oidc":
+		if s.oidc == nil || !s.oidc.allowed(name, sess.Groups) {
+			return ""
+		}
+	case "user":
+		if !s.config.Accounts {
+			return ""
+		}
+		if a, err := loadAccount(s.store, name); err != nil || a.PasswordGeneration != sess.PasswordGeneration {
+			return ""
+		}
+	default:
+		return ""
+	}
+	return sess.Identity
+}
+
+// displayName returns the name of identity shown to its user.
+func displayName(identity string) string {
+	_, name, _ := strings.Cut(identity, ":")
+	return name
+}
+
+// setCookie sets a cookie only sent back by the site itself.
+func (s *Server) setCookie(c *gin.Context, name string, value string, expires time.Time) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(s.config.PublicURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (s *Server) clearCookie(c *gin.Context, name string) {
+	http.SetCookie(c.Writer, &http.Cookie{Name: name, Path: "/", MaxAge: -1})
+}
+
+// handleLogout ends the session.
+func (s *Server) handleLogout(c *gin.Context) {
+	s.clearCookie(c, sessionCookie)
+	c.Redirect(http.StatusSeeOther, "/")
+}
+
+// homePage returns the home page for the browser of the request.
+func (s *Server) homePage(c *gin.Context) *Page {
+	p := NewPage(*s.config, s.store)
+	identity := s.sessionIdentity(c)
+	p.User = displayName(identity)
+	// with API tokens only, the token is entered along with the upload
+	p.SignInRequired = identity == "" && s.signInEnabled() && (s.config.RequireAuth || s.oidc != nil)
+	return p
+}
+
+// showLoginError shows the home page with message.
+func (s *Server) showLoginError(c *gin.Context, status int, message string) {
+	p := s.homePage(c)
+	p.Error = message
+	c.Status(status)
+	p.handleGetHome(c.Writer, s.indexTemplate)
+}
+
+// safeRedirect returns next if it is a path of this site, / otherwise.
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
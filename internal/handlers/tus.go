@@ -0,0 +1,485 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	"github.com/tuilakhanh/webshare/internal/pkg"
+)
+
+// Resumable uploads following the tus 1.0.0 protocol (https://tus.io/protocols/resumable-upload)
+// with the creation, expiration and termination extensions. The chunks are
+// appended to a file in the upload directory and once the upload is complete
+// it is stored just like a regular POST upload.
+
+const tusVersion = "1.0.0"
+
+// tusUpload is the state of a resumable upload, kept next to its data as
+// <upload id>.info in the upload directory.
+type tusUpload struct {
+	ID       string
+	Length   int64
+	Metadata string
+	Filename string
+	Expires  time.Time
+	// Options are the upload options passed in the metadata
+	Options uploadOptions
+	// Link is the "<id>/<name>" of the share once the upload is complete
+	Link string
+}
+
+// tusLocks serializes the requests touching the same upload. The locks of
+// uploads that are gone are dropped by deleteExpiredUploads.
+var tusLocks sync.Map
+
+func lockUpload(uploadID string) (unlock func(), ok bool) {
+	v, _ := tusLocks.LoadOrStore(uploadID, new(sync.Mutex))
+	mu := v.(*sync.Mutex)
+	if !mu.TryLock() {
+		return nil, false
+	}
+	return mu.Unlock, true
+}
+
+func (s *Server) tusDataPath(uploadID string) string {
+	return filepath.Join(s.config.UploadDirectory, uploadID+".bin")
+}
+
+func (s *Server) tusInfoPath(uploadID string) string {
+	return filepath.Join(s.config.UploadDirectory, uploadID+".info")
+}
+
+func (s *Server) loadUpload(uploadID string) (u *tusUpload, err error) {
+	// upload IDs are hex, anything else can not be an upload of ours
+	if _, err := hex.DecodeString(uploadID); err != nil || uploadID == "" {
+		return nil, fs.ErrNotExist
+	}
+	b, err := os.ReadFile(s.tusInfoPath(uploadID))
+	if err != nil {
+		return
+	}
+	u = new(tusUpload)
+	err = json.Unmarshal(b, u)
+	return
+}
+
+// loadUploadOf loads the upload the request is about. Uploads created by
+// another client look like they do not exist.
+func (s *Server) loadUploadOf(c *gin.Context) (*tusUpload, error) {
+	u, err := s.loadUpload(c.Param("uid"))
+	if err == nil && u.Options.Uploader != uploader(c) {
+		return nil, fs.ErrNotExist
+	}
+	return u, err
+}
+
+func (s *Server) saveUpload(u *tusUpload) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	tempName := s.tusInfoPath(u.ID) + ".tmp"
+	if err := os.WriteFile(tempName, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tempName, s.tusInfoPath(u.ID))
+}
+
+func (s *Server) removeUpload(uploadID string) {
+	os.Remove(s.tusDataPath(uploadID))
+	os.Remove(s.tusInfoPath(uploadID))
+	tusLocks.Delete(uploadID)
+}
+
+// uploadOffset returns how many bytes of the upload have been received.
+func (s *Server) uploadOffset(uploadID string) (int64, error) {
+	fi, err := os.Stat(s.tusDataPath(uploadID))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// tusMiddleware sets the headers every tus response needs and rejects
+// clients speaking another version of the protocol.
+func (s *Server) tusMiddleware(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Cache-Control", "no-store")
+	if c.Request.Method != http.MethodOptions && c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.AbortWithStatus(http.StatusPreconditionFailed)
+		return
+	}
+	c.Next()
+}
+
+func (s *Server) handleTusOptions(c *gin.Context) {
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", "creation,expiration,termination")
+	c.Header("Tus-Max-Size", strconv.FormatInt(s.config.MaxBytesPerFile, 10))
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) handleTusCreate(c *gin.Context) {
+	if c.GetHeader("Upload-Defer-Length") != "" {
+		c.String(http.StatusBadRequest, "Upload-Defer-Length is not supported")
+		return
+	}
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		c.String(http.StatusBadRequest, "Invalid Upload-Length")
+		return
+	}
+	if length > s.config.MaxBytesPerFile {
+		c.String(http.StatusRequestEntityTooLarge, fmt.Sprintf("Upload exceeds max file size: %s.", s.config.MaxBytesPerFileHuman))
+		return
+	}
+	remaining, limited, err := s.remainingQuota(uploader(c))
+	if err != nil {
+		log.Error().Err(err).Str("uploader", uploader(c)).Msg("Error checking storage quota")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if limited && length > remaining {
+		c.String(http.StatusRequestEntityTooLarge, quotaMessage(remaining))
+		return
+	}
+	metadata, err := parseUploadMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid Upload-Metadata")
+		return
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	u := &tusUpload{
+		ID:       hex.EncodeToString(b),
+		Length:   length,
+		Metadata: c.GetHeader("Upload-Metadata"),
+		Filename: "upload",
+		Expires:  time.Now().Add(s.config.UploadExpiry),
+		Options:  uploadOptions{Uploader: uploader(c)},
+	}
+	for key, value := range metadata {
+		if err := u.Options.set(key, value); errors.Is(err, errPasswordTooLong) {
+			c.String(http.StatusBadRequest, passwordTooLongMessage)
+			return
+		} else if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	// keep the password itself out of the upload info
+	u.Metadata = removeMetadataKey(u.Metadata, "password")
+	for _, key := range []string{"filename", "name"} {
+		if metadata[key] == "" {
+			continue
+		}
+		// checked here already, so that a bad name does not fail the
+		// upload at the very end
+		name, _, err := pkg.SanitizeFilename(metadata[key])
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		u.Filename = name
+		break
+	}
+
+	if err := os.MkdirAll(s.config.UploadDirectory, os.ModePerm); err != nil {
+		log.Error().Err(err).Msg("Error creating upload directory")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	f, err := os.Create(s.tusDataPath(u.ID))
+	if err != nil {
+		log.Error().Err(err).Msg("Error creating upload file")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+	if err := s.saveUpload(u); err != nil {
+		log.Error().Err(err).Msg("Error saving upload info")
+		s.removeUpload(u.ID)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	log.Debug().Str("upload_id", u.ID).Int64("length", length).Msg("Created resumable upload")
+
+	if length == 0 {
+		page, deleteToken, err := s.finishUpload(u)
+		if err != nil {
+			s.abortFinish(c, u, err)
+			return
+		}
+		c.Header("Webshare-Id", u.Link)
+		c.Header("Webshare-Delete-Token", deleteToken)
+		c.Header("Webshare-Expires", page.ExpiresAt.UTC().Format(http.TimeFormat))
+		c.Header("Webshare-Sha256", page.SHA256)
+	} else {
+		c.Header("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	}
+	c.Header("Location", "/files/"+u.ID)
+	c.Status(http.StatusCreated)
+}
+
+func (s *Server) handleTusHead(c *gin.Context) {
+	u, err := s.loadUploadOf(c)
+	if err != nil || (u.Link == "" && time.Now().After(u.Expires)) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	offset, err := s.uploadOffset(u.ID)
+	if u.Link != "" {
+		offset, err = u.Length, nil
+		c.Header("Webshare-Id", u.Link)
+	} else {
+		c.Header("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	}
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(u.Length, 10))
+	if u.Metadata != "" {
+		c.Header("Upload-Metadata", u.Metadata)
+	}
+	c.Status(http.StatusOK)
+}
+
+func (s *Server) handleTusPatch(c *gin.Context) {
+	if c.ContentType() != "application/offset+octet-stream" {
+		c.AbortWithStatus(http.StatusUnsupportedMediaType)
+		return
+	}
+	unlock, ok := lockUpload(c.Param("uid"))
+	if !ok {
+		c.String(http.StatusLocked, "Upload is in use by another request")
+		return
+	}
+	defer unlock()
+
+	u, err := s.loadUploadOf(c)
+	if err != nil || u.Link != "" || time.Now().After(u.Expires) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	offset, err := s.uploadOffset(u.ID)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if c.GetHeader("Upload-Offset") != strconv.FormatInt(offset, 10) {
+		c.AbortWithStatus(http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(s.tusDataPath(u.ID), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		log.Error().Err(err).Str("upload_id", u.ID).Msg("Error opening upload file")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	// whatever arrives before the connection drops is kept, that is
+	// what makes the upload resumable
+	n, err := io.Copy(f, io.LimitReader(c.Request.Body, u.Length-offset))
+	f.Close()
+	offset += n
+	if err != nil {
+		log.Debug().Err(err).Str("upload_id", u.ID).Int64("offset", offset).Msg("Upload interrupted")
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if offset == u.Length {
+		page, deleteToken, err := s.finishUpload(u)
+		if err != nil {
+			s.abortFinish(c, u, err)
+			return
+		}
+		c.Header("Webshare-Id", u.Link)
+		c.Header("Webshare-Delete-Token", deleteToken)
+		c.Header("Webshare-Expires", page.ExpiresAt.UTC().Format(http.TimeFormat))
+		c.Header("Webshare-Sha256", page.SHA256)
+	} else {
+		c.Header("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	}
+	c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) handleTusDelete(c *gin.Context) {
+	unlock, ok := lockUpload(c.Param("uid"))
+	if !ok {
+		c.String(http.StatusLocked, "Upload is in use by another request")
+		return
+	}
+	defer unlock()
+
+	if _, err := s.loadUploadOf(c); err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	s.removeUpload(c.Param("uid"))
+	c.Status(http.StatusNoContent)
+}
+
+// handleTusOverride lets clients that can not send PATCH or DELETE use POST
+// with the X-HTTP-Method-Override header instead.
+func (s *Server) handleTusOverride(c *gin.Context) {
+	switch c.GetHeader("X-HTTP-Method-Override") {
+	case http.MethodPatch:
+		s.handleTusPatch(c)
+	case http.MethodDelete:
+		s.handleTusDelete(c)
+	case http.MethodHead:
+		s.handleTusHead(c)
+	default:
+		c.AbortWithStatus(http.StatusMethodNotAllowed)
+	}
+}
+
+// finishUpload hands the received data over to the same step that stores
+// regular uploads. The upload info is kept until it expires so that clients
+// can still look up the resulting share, the delete token is only returned
+// here.
+func (s *Server) finishUpload(u *tusUpload) (page *Page, deleteToken string, err error) {
+	// the quota was checked when the upload was created, others may have
+	// used it up since
+	release, err := s.reserveQuota(u.Options.Uploader, u.Length)
+	if err != nil {
+		return
+	}
+	defer release()
+
+	f, err := os.Open(s.tusDataPath(u.ID))
+	if err != nil {
+		log.Error().Err(err).Str("upload_id", u.ID).Msg("Error opening upload file")
+		return
+	}
+	defer f.Close()
+
+	page, deleteToken, err = copyToContentDirectory(u.Filename, f, u.Options, *s.config, s.store)
+	if err != nil {
+		return
+	}
+	u.Link = path.Join(page.ID, page.Name)
+	s.expiry.schedule(page.ID, page.ExpiresAt)
+	os.Remove(s.tusDataPath(u.ID))
+	log.Debug().Str("upload_id", u.ID).Str("link", u.Link).Msg("Finished resumable upload")
+	return page, deleteToken, s.saveUpload(u)
+}
+
+// abortFinish answers a request whose upload could not be stored. An upload
+// that does not have the checksum it was created with, or that no longer
+// fits the quota, is dropped, resuming it would not help.
+func (s *Server) abortFinish(c *gin.Context, u *tusUpload, err error) {
+	if errors.Is(err, errChecksumMismatch) {
+		s.removeUpload(u.ID)
+		// the status the checksum extension of tus uses
+		c.String(460, err.Error())
+		return
+	}
+	if errors.Is(err, errNotEncrypted) {
+		s.removeUpload(u.ID)
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	var quotaErr *quotaError
+	if errors.As(err, &quotaErr) {
+		s.removeUpload(u.ID)
+		c.String(http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	c.AbortWithStatus(http.StatusInternalServerError)
+}
+
+// deleteExpiredUploads removes the resumable uploads that expired, and the
+// locks of the uploads that are gone, which requests for uploads that never
+// existed leave behind as well.
+func (s *Server) deleteExpiredUploads() {
+	tusLocks.Range(func(key, v any) bool {
+		uploadID, mu := key.(string), v.(*sync.Mutex)
+		if _, err := os.Stat(s.tusInfoPath(uploadID)); errors.Is(err, fs.ErrNotExist) && mu.TryLock() {
+			tusLocks.Delete(uploadID)
+			mu.Unlock()
+		}
+		return true
+	})
+
+	files, err := os.ReadDir(s.config.UploadDirectory)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Error().Err(err).Msg("Error reading upload directory")
+		}
+		return
+	}
+	for _, f := range files {
+		uploadID, ok := strings.CutSuffix(f.Name(), ".info")
+		if !ok {
+			continue
+		}
+		u, err := s.loadUpload(uploadID)
+		if err != nil || time.Now().After(u.Expires) {
+			log.Debug().Str("upload_id", uploadID).Msg("Deleting expired upload")
+			s.removeUpload(uploadID)
+		}
+	}
+}
+
+// parseUploadMetadata decodes the Upload-Metadata header, a comma separated
+// list of keys with optional base64 encoded values.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		switch len(fields) {
+		case 1:
+			metadata[fields[0]] = ""
+		case 2:
+			value, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, err
+			}
+			metadata[fields[0]] = string(value)
+		default:
+			return nil, errors.New("malformed metadata pair")
+		}
+	}
+	return metadata, nil
+}
+
+// removeMetadataKey drops key from an Upload-Metadata header.
+func removeMetadataKey(header string, key string) string {
+	var kept []string
+	for _, pair := range strings.Split(header, ",") {
+		if fields := strings.Fields(pair); len(fields) > 0 && fields[0] != key {
+			kept = append(kept, strings.TrimSpace(pair))
+		}
+	}
+	return strings.Join(kept, ",")
+}
@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"net/http"
+	"path"
+	"testing"
+)
+
+func TestTusLocksReaped(t *testing.T) {
+	ts := newTestServer(t, nil)
+	token, err := ts.server.CreateToken("ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := ts.tusCreate(t, token, 10)
+	if status := ts.tusPatch(t, token, kept, "01234"); status != http.StatusNoContent {
+		t.Fatalf("patching: got %d, want %d", status, http.StatusNoContent)
+	}
+	// requests for uploads that do not exist take a lock as well
+	if status := ts.tusPatch(t, token, ts.app.URL+"/files/0123456789abcdef", "x"); status != http.StatusNotFound {
+		t.Fatalf("patching a missing upload: got %d, want %d", status, http.StatusNotFound)
+	}
+
+	ts.server.deleteExpiredUploads()
+	if _, ok := tusLocks.Load("0123456789abcdef"); ok {
+		t.Error("the lock of a missing upload was kept")
+	}
+	if _, ok := tusLocks.Load(path.Base(kept)); !ok {
+		t.Error("the lock of an upload in progress was dropped")
+	}
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/tuilakhanh/webshare/internal/config"
+	"github.com/tuilakhanh/webshare/internal/pkg"
+)
+
+// contentSecurityPolicy is sent along with every upload. The sandbox gives
+// the document an origin of its own without scripts, so even HTML that is
+// opened directly can not reach the cookies or the storage of the site.
+const contentSecurityPolicy = "default-src 'none'; img-src 'self' data:; media-src 'self'; style-src 'unsafe-inline'; sandbox"
+
+// setContentSafetyHeaders sets the headers that keep an upload from being
+// run as anything but what it was served as.
+func setContentSafetyHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Security-Policy", contentSecurityPolicy)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cross-Origin-Opener-Policy", "same-origin")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+}
+
+// safeContentType returns the content type and the disposition to serve the
+// data of p with. Active content is only shown inline at the usercontent
+// origin, at the origin of the site it is downloaded or shown as text.
+func (p *Page) safeContentType(r *http.Request) (contentType string, disposition string) {
+	if !pkg.IsActiveContent(p.ContentType) || isUserContentHost(p.Config, r) {
+		return p.ContentType, "inline"
+	}
+	if p.Config.ActiveContent == "text" {
+		return "text/plain; charset=utf-8", "inline"
+	}
+	return p.ContentType, "attachment"
+}
+
+// isUserContentHost reports whether r was sent to the usercontent origin.
+func isUserContentHost(config config.Config, r *http.Request) bool {
+	if config.UserContentURL == "" {
+		return false
+	}
+	u, err := url.Parse(config.UserContentURL)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// userContentMiddleware keeps the usercontent origin from serving anything
+// but the uploads, the pages of the site belong to its own origin.
+func (s *Server) userContentMiddleware(c *gin.Context) {
+	if isUserContentHost(*s.config, c.Request) && !strings.HasPrefix(c.Request.URL.Path, "/1/") {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	c.Next()
+}
+
+// atUserContent reports whether the data of page is served from the
+// usercontent origin. Password protected files stay at the origin of the
+// site, where the unlock cookie is sent, and so do end-to-end encrypted ones,
+// which the share page fetches to decrypt them.
+func atUserContent(config config.Config, page *Page) bool {
+	return config.UserContentURL != "" && page.PasswordHash == "" && !page.Encrypted
+}
+
+// rawLink returns the URL of the data of page.
+func rawLink(config config.Config, page *Page) string {
+	link := "/1/" + page.ID + "/" + url.PathEscape(page.Name)
+	if !atUserContent(config, page) {
+		return link
+	}
+	return config.UserContentURL + link
+}
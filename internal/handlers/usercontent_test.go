@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/tuilakhanh/webshare/internal/config"
+)
+
+const script = "<html><script>alert(document.cookie)</script></html>"
+
+// uploadFile uploads content as a file called name and returns its ID and
+// name.
+func (ts *testServer) uploadFile(t *testing.T, name string, fields map[string]string, content string) string {
+	t.Helper()
+	resp := ts.postFile(t, name, fields, content)
+	var u uploaded
+	if err := json.NewDecoder(resp.Body).Decode(&u); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload: got %s, %v", resp.Status, err)
+	}
+	return u.ID
+}
+
+// getAt requests path of the server as if it was sent to host.
+func (ts *testServer) getAt(t *testing.T, host string, path string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, ts.app.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readResponse(t, resp)
+}
+
+func TestContentSafetyHeaders(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		active      string
+		file        string
+		content     string
+		contentType string
+		disposition string
+	}{
+		{"text", "attachment", "notes.txt", "just text", "text/plain", "inline"},
+		{"html", "attachment", "page.html", script, "text/html", "attachment"},
+		{"xml", "attachment", "image.svg", `<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`, "text/xml", "attachment"},
+		// the type is sniffed, whatever the name says
+		{"svg sniffed as text", "attachment", "image.svg", `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`, "text/plain", "inline"},
+		{"html as text", "text", "page.html", script, "text/plain; charset=utf-8", "inline"},
+		// the name does not make text active
+		{"text named html", "attachment", "page.html", "just text", "text/plain", "inline"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, func(cfg *config.Config) { cfg.ActiveContent = tt.active })
+			id := ts.uploadFile(t, tt.file, nil, tt.content)
+			resp := ts.request(t, http.MethodGet, "/1/"+id, map[string]string{"Accept-Encoding": "identity"})
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("GET: got %s", resp.Status)
+			}
+			h := resp.Header
+			if got := h.Get("Content-Security-Policy"); got != contentSecurityPolicy || !strings.HasSuffix(got, "sandbox") {
+				t.Errorf("Content-Security-Policy: got %q", got)
+			}
+			if got := h.Get("X-Content-Type-Options"); got != "nosniff" {
+				t.Errorf("X-Content-Type-Options: got %q, want nosniff", got)
+			}
+			if got := h.Get("Content-Type"); !strings.HasPrefix(got, tt.contentType) {
+				t.Errorf("Content-Type: got %q, want %q", got, tt.contentType)
+			}
+			if got := h.Get("Content-Disposition"); !strings.HasPrefix(got, tt.disposition+";") {
+				t.Errorf("Content-Disposition: got %q, want %s", got, tt.disposition)
+			}
+		})
+	}
+}
+
+func TestUserContentOrigin(t *testing.T) {
+	const host = "usercontent.test"
+	ts := newTestServer(t, func(cfg *config.Config) { cfg.UserContentURL = "http://" + host })
+	id := ts.uploadFile(t, "page.html", nil, script)
+
+	// the site sends the files to the usercontent origin
+	resp := ts.request(t, http.MethodGet, "/1/"+id, map[string]string{"Accept-Encoding": "identity"})
+	if resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("Location") != "http://"+host+"/1/"+id {
+		t.Errorf("GET at the site: got %s to %q, want a redirect to the usercontent origin", resp.Status, resp.Header.Get("Location"))
+	}
+
+	// which shows active content inline, in the sandbox
+	resp = ts.getAt(t, host, "/1/"+id)
+	if resp.StatusCode != http.StatusOK || body(t, resp) != script {
+		t.Fatalf("GET at the usercontent origin: got %s", resp.Status)
+	}
+	if got := resp.Header.Get("Content-Disposition"); !strings.HasPrefix(got, "inline;") {
+		t.Errorf("Content-Disposition: got %q, want inline", got)
+	}
+	if got := resp.Header.Get("Content-Security-Policy"); got != contentSecurityPolicy {
+		t.Errorf("Content-Security-Policy: got %q", got)
+	}
+
+	// and nothing but the files
+	for _, path := range []string{"/", "/" + id, "/my", "/api/uploads"} {
+		if resp := ts.getAt(t, host, path); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s at the usercontent origin: got %s, want %d", path, resp.Status, http.StatusNotFound)
+		}
+	}
+
+	// password protected files stay at the site, where the unlock cookie is
+	locked := ts.uploadFile(t, "page.html", map[string]string{"password": "secret"}, script)
+	resp = ts.request(t, http.MethodGet, "/1/"+locked, map[string]string{"Accept-Encoding": "identity", "X-Share-Password": "secret"})
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Disposition"), "attachment;") {
+		t.Errorf("GET of a password protected file: got %s with %q, want it as an attachment", resp.Status, resp.Header.Get("Content-Disposition"))
+	}
+}
@@ -0,0 +1,291 @@
+// Package mockoidc is an OpenID Connect provider for trying out and testing
+// the sign in of webshare without a real identity provider. It signs in
+// whoever asks as whatever email address and groups they enter, so it must
+// never be reachable from the outside. The mock-oidc command serves it.
+package mockoidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// codeLifetime is how long an authorization code can be exchanged.
+const codeLifetime = time.Minute
+
+// authorization is what a code stands for until it is exchanged.
+type authorization struct {
+	clientID    string
+	redirectURI string
+	challenge   string
+	nonce       string
+	email       string
+	// unverified leaves out the email_verified claim, as providers do that
+	// do not verify addresses
+	unverified bool
+	groups     []string
+	expires    time.Time
+}
+
+// Provider is the mock provider. Issuer must be set to the URL it is served
+// at before it is used.
+type Provider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+
+	key   *rsa.PrivateKey
+	keyID string
+	mux   *http.ServeMux
+
+	mu    sync.Mutex
+	codes map[string]*authorization
+}
+
+// New returns a provider that only accepts the client with the given ID and
+// secret, an empty secret for a public client.
+func New(clientID string, clientSecret string) (*Provider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	p := &Provider{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		key:          key,
+		keyID:        randomString(8),
+		mux:          http.NewServeMux(),
+		codes:        make(map[string]*authorization),
+	}
+	p.mux.HandleFunc("GET /.well-known/openid-configuration", p.handleDiscovery)
+	p.mux.HandleFunc("GET /jwks", p.handleKeys)
+	p.mux.HandleFunc("GET /authorize", p.handleAuthorize)
+	p.mux.HandleFunc("POST /authorize", p.handleAuthorize)
+	p.mux.HandleFunc("POST /token", p.handleToken)
+	return p, nil
+}
+
+func (p *Provider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mux.ServeHTTP(w, r)
+}
+
+func (p *Provider) issuer() string {
+	return strings.TrimSuffix(p.Issuer, "/")
+}
+
+func (p *Provider) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                p.issuer(),
+		"authorization_endpoint":                p.issuer() + "/authorize",
+		"token_endpoint":                        p.issuer() + "/token",
+		"jwks_uri":                              p.issuer() + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"scopes_supported":                      []string{"openid", "email", "profile", "groups"},
+		"claims_supported":                      []string{"sub", "email", "email_verified", "groups"},
+	})
+}
+
+func (p *Provider) handleKeys(w http.ResponseWriter, r *http.Request) {
+	pub := p.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": p.keyID,
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+var signInPage = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<title>Mock sign in</title>
+<h1>Mock sign in</h1>
+<form method="post">
+{{range $k, $v := .Query}}<input type="hidden" name="{{$k}}" value="{{index $v 0}}">
+{{end}}<p><label>Email <input name="email" value="user@example.com"></label></p>
+<p><label>Groups <input name="groups" placeholder="staff, admins"></label></p>
+<p><label><input type="checkbox" name="unverified"> Email not verified</label></p>
+<p><label><input type="checkbox" name="deny"> Deny</label></p>
+<button type="submit">Sign in</button>
+</form>
+`))
+
+// handleAuthorize shows the sign in form, and redirects back to the client
+// with a code once it is posted.
+func (p *Provider) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := r.Form
+	if q.Get("client_id") != p.ClientID {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || !redirect.IsAbs() {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if q.Get("response_type") != "code" || !strings.Contains(" "+q.Get("scope")+" ", " openid ") {
+		http.Error(w, "only the code flow of OpenID Connect is supported", http.StatusBadRequest)
+		return
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "PKCE with S256 is required", http.StatusBadRequest)
+		return
+	}
+	if r.Method == http.MethodGet {
+		signInPage.Execute(w, map[string]any{"Query": r.URL.Query()})
+		return
+	}
+
+	params := url.Values{"state": {q.Get("state")}}
+	if q.Get("deny") != "" {
+		params.Set("error", "access_denied")
+	} else {
+		code := randomString(24)
+		var groups []string
+		for _, group := range strings.Split(q.Get("groups"), ",") {
+			if group = strings.TrimSpace(group); group != "" {
+				groups = append(groups, group)
+			}
+		}
+		p.mu.Lock()
+		p.codes[code] = &authorization{
+			clientID:    q.Get("client_id"),
+			redirectURI: q.Get("redirect_uri"),
+			challenge:   q.Get("code_challenge"),
+			nonce:       q.Get("nonce"),
+			email:       q.Get("email"),
+			unverified:  q.Get("unverified") != "",
+			groups:      groups,
+			expires:     time.Now().Add(codeLifetime),
+		}
+		p.mu.Unlock()
+		params.Set("code", code)
+	}
+	if redirect.RawQuery != "" {
+		redirect.RawQuery += "&"
+	}
+	redirect.RawQuery += params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// handleToken exchanges a code for the ID token.
+func (p *Provider) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request")
+		return
+	}
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != p.ClientID || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(p.ClientSecret)) != 1 {
+		tokenError(w, "invalid_client")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, "unsupported_grant_type")
+		return
+	}
+
+	// codes can only be used once, whatever the outcome
+	p.mu.Lock()
+	auth := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mu.Unlock()
+	if auth == nil || time.Now().After(auth.expires) || auth.clientID != clientID || auth.redirectURI != r.PostForm.Get("redirect_uri") {
+		tokenError(w, "invalid_grant")
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != auth.challenge {
+		tokenError(w, "invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]any{
+		"iss":            p.issuer(),
+		"sub":            auth.email,
+		"aud":            clientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"email":          auth.email,
+		"email_verified": true,
+		"groups":         auth.groups,
+	}
+	if auth.unverified {
+		delete(claims, "email_verified")
+	}
+	if auth.nonce != "" {
+		claims["nonce"] = auth.nonce
+	}
+	idToken, err := p.sign(claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": randomString(24),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+// sign returns claims as a JWT signed with RS256.
+func (p *Provider) sign(claims map[string]any) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": p.keyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,103 @@
+package pkg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/tuilakhanh/webshare/internal/config"
+)
+
+// Codecs the uploads can be stored with. The names double as the HTTP
+// content codings, so stored data can be sent to clients as is.
+const (
+	CodecIdentity = "identity"
+	CodecGzip     = "gzip"
+	CodecZstd     = "zstd"
+)
+
+// SampleLen is the number of leading bytes ChooseCodec measures the
+// compression ratio on.
+const SampleLen = 64 << 10
+
+// incompressibleTypes are content types that are compressed already, so
+// compressing them again only wastes CPU.
+var incompressibleTypes = []string{
+	"image/jpeg", "image/png", "image/gif", "image/webp", "image/avif", "image/heif",
+	"video/", "audio/mpeg", "audio/aac", "audio/ogg", "audio/mp4", "audio/x-flac", "audio/webm",
+	"application/zip", "application/gzip", "application/x-bzip2", "application/x-xz",
+	"application/x-7z-compressed", "application/vnd.rar", "application/x-rar-compressed",
+	"application/zstd", "application/x-compress", "application/epub+zip",
+}
+
+// ChooseCodec decides how an upload is stored from its content type and
+// the compression ratio of its first SampleLen bytes.
+func ChooseCodec(config config.Config, contentType string, sample []byte) string {
+	codec := config.Codec
+	if codec == "none" || codec == "" {
+		return CodecIdentity
+	}
+	for _, t := range incompressibleTypes {
+		if strings.HasPrefix(contentType, t) {
+			return CodecIdentity
+		}
+	}
+	if len(sample) == 0 {
+		return codec
+	}
+
+	compressed := new(bytes.Buffer)
+	w, err := NewCodecWriter(compressed, codec)
+	if err != nil {
+		return CodecIdentity
+	}
+	w.Write(sample)
+	w.Close()
+	if float64(compressed.Len()) > config.CompressionThreshold*float64(len(sample)) {
+		return CodecIdentity
+	}
+	return codec
+}
+
+// NewCodecWriter returns a writer that encodes everything written to it with
+// codec. Close must be called to flush it.
+func NewCodecWriter(w io.Writer, codec string) (io.WriteCloser, error) {
+	switch codec {
+	case CodecIdentity:
+		return nopWriteCloser{w}, nil
+	case CodecGzip:
+		return gzip.NewWriter(w), nil
+	case CodecZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unknown codec %q", codec)
+}
+
+// NewCodecReader returns a reader that decodes the data read from r with
+// codec. Closing it does not close r.
+func NewCodecReader(r io.Reader, codec string) (io.ReadCloser, error) {
+	switch codec {
+	case CodecIdentity:
+		return io.NopCloser(r), nil
+	case CodecGzip, "":
+		// metadata written before codecs were recorded is always gzipped
+		return gzip.NewReader(r)
+	case CodecZstd:
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unknown codec %q", codec)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,63 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/tuilakhanh/webshare/internal/config"
+)
+
+func TestChooseCodec(t *testing.T) {
+	text := []byte(strings.Repeat("the same words over and over ", 1000))
+	random := make([]byte, SampleLen)
+	rand.Read(random)
+	for _, tt := range []struct {
+		name        string
+		codec       string
+		contentType string
+		sample      []byte
+		want        string
+	}{
+		{"text", "gzip", "text/plain", text, CodecGzip},
+		{"text with zstd", "zstd", "text/plain", text, CodecZstd},
+		{"random data", "gzip", "application/octet-stream", random, CodecIdentity},
+		{"compressed type", "gzip", "image/png", text, CodecIdentity},
+		{"compressed type prefix", "zstd", "video/mp4", text, CodecIdentity},
+		{"empty", "gzip", "text/plain", nil, CodecGzip},
+		{"compression off", "none", "text/plain", text, CodecIdentity},
+		{"no codec", "", "text/plain", text, CodecIdentity},
+	} {
+		cfg := config.Config{Codec: tt.codec, CompressionThreshold: 0.9}
+		if got := ChooseCodec(cfg, tt.contentType, tt.sample); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	data := []byte(strings.Repeat("round trip ", 500))
+	for _, codec := range []string{CodecIdentity, CodecGzip, CodecZstd} {
+		buf := new(bytes.Buffer)
+		w, err := NewCodecWriter(buf, codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewCodecReader(buf, codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: got %d bytes, %v, want %d", codec, len(got), err, len(data))
+		}
+	}
+	if _, err := NewCodecWriter(io.Discard, "lzma"); err == nil {
+		t.Error("NewCodecWriter: no error for an unknown codec")
+	}
+}
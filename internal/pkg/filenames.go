@@ -0,0 +1,132 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// ErrInvalidFilename is returned for uploads whose name can not be used.
+var ErrInvalidFilename = errors.New("invalid filename")
+
+// MaxFilenameLen is the maximum length of a file name in bytes, the limit
+// of most file systems.
+const MaxFilenameLen = 255
+
+// reservedFilenames are the device names of Windows, which can not be saved
+// there whatever the extension.
+var reservedFilenames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// unsafeFilenameChars have a meaning in URLs or paths, or can not be used in
+// file names on Windows.
+const unsafeFilenameChars = `?#%"<>:*|`
+
+// SanitizeFilename checks the name of an upload as sent by the client. It
+// returns the name to show, which is the base name in NFC with at most
+// MaxFilenameLen bytes, and the name to use in URLs and the storage, which is
+// the same with the characters that are unsafe there replaced by "_".
+func SanitizeFilename(name string) (display string, safe string, err error) {
+	// clients send the full path now and then, with either separator
+	name = name[strings.LastIndexAny(name, `/\`)+1:]
+	if !utf8.ValidString(name) {
+		return "", "", fmt.Errorf("%w: not UTF-8", ErrInvalidFilename)
+	}
+	name = norm.NFC.String(name)
+	for _, r := range name {
+		// format characters include the bidirectional overrides that
+		// disguise the extension
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return "", "", fmt.Errorf("%w: contains control character %U", ErrInvalidFilename, r)
+		}
+	}
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." {
+		return "", "", fmt.Errorf("%w: empty", ErrInvalidFilename)
+	}
+	base, _, _ := strings.Cut(name, ".")
+	if reservedFilenames[strings.ToUpper(strings.TrimSpace(base))] {
+		return "", "", fmt.Errorf("%w: %s is a reserved name", ErrInvalidFilename, base)
+	}
+
+	display = truncateFilename(name, MaxFilenameLen)
+	safe = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(unsafeFilenameChars, r) {
+			return '_'
+		}
+		return r
+	}, display)
+	return display, safe, nil
+}
+
+// truncateFilename shortens name to at most n bytes, keeping the extension
+// and whole characters.
+func truncateFilename(name string, n int) string {
+	if len(name) <= n {
+		return name
+	}
+	ext := path.Ext(name)
+	if len(ext) > n/2 {
+		ext = ""
+	}
+	stem := name[:len(name)-len(ext)]
+	for len(stem)+len(ext) > n {
+		_, size := utf8.DecodeLastRuneInString(stem)
+		stem = stem[:len(stem)-size]
+	}
+	return stem + ext
+}
+
+// ContentDisposition returns the Content-Disposition header (RFC 6266) for
+// a file called name. Names that are not plain ASCII are sent in the
+// filename* parameter (RFC 5987), with an ASCII approximation in filename
+// for clients that do not understand it.
+func ContentDisposition(disposition string, name string) string {
+	fallback := asciiFilename(name)
+	value := disposition + `; filename="` + fallback + `"`
+	if fallback != name {
+		value += "; filename*=UTF-8''" + encodeRFC5987(name)
+	}
+	return value
+}
+
+// asciiFilename approximates name in printable ASCII for a quoted string:
+// accents are dropped and everything else that does not fit becomes "_".
+func asciiFilename(name string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(name) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+		case r == '"' || r == '\\' || r < ' ' || r > '~':
+			b.WriteRune('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// encodeRFC5987 percent-encodes s as the value of an extended parameter,
+// leaving only the attr-char of RFC 5987 as they are.
+func encodeRFC5987(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x80 && (unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)) || strings.IndexByte("!#$&+-.^_`|~", c) >= 0) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,88 @@
+package pkg
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		display string
+		safe    string
+	}{
+		{"report.pdf", "report.pdf", "report.pdf"},
+		{`C:\Users\me\report.pdf`, "report.pdf", "report.pdf"},
+		{"../../etc/passwd", "passwd", "passwd"},
+		{"  spaced.txt ", "spaced.txt", "spaced.txt"},
+		{"a?b#c%d.txt", "a?b#c%d.txt", "a_b_c_d.txt"},
+		{`<script>"x".html`, `<script>"x".html`, "_script__x_.html"},
+		{"cafe\u0301.txt", "caf\u00e9.txt", "caf\u00e9.txt"},
+		{"console.log", "console.log", "console.log"},
+		{".bashrc", ".bashrc", ".bashrc"},
+	} {
+		display, safe, err := SanitizeFilename(tt.name)
+		if err != nil || display != tt.display || safe != tt.safe {
+			t.Errorf("SanitizeFilename(%q): got %q, %q, %v, want %q, %q", tt.name, display, safe, err, tt.display, tt.safe)
+		}
+	}
+
+	for _, name := range []string{
+		"", ".", "..", "   ", "dir/",
+		"\xff.txt",
+		"line\nbreak.txt",
+		"nul\x00.txt",
+		// shows as "invoiceexe.pdf"
+		"invoice\u202Efdp.exe",
+		"zero\u200Bwidth.txt",
+		"CON", "con.txt", "Com1.tar.gz", "LPT9 .txt",
+	} {
+		if display, safe, err := SanitizeFilename(name); !errors.Is(err, ErrInvalidFilename) {
+			t.Errorf("SanitizeFilename(%q): got %q, %q, %v, want ErrInvalidFilename", name, display, safe, err)
+		}
+	}
+}
+
+func TestSanitizeFilenameLength(t *testing.T) {
+	for _, name := range []string{
+		strings.Repeat("a", 300) + ".txt",
+		strings.Repeat("\u00e9", 200) + ".txt",
+		strings.Repeat("\U0001F600", 100),
+		"a." + strings.Repeat("b", 300),
+	} {
+		display, _, err := SanitizeFilename(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(display) > MaxFilenameLen || !utf8.ValidString(display) {
+			t.Errorf("got %d bytes, valid UTF-8 %v, want at most %d", len(display), utf8.ValidString(display), MaxFilenameLen)
+		}
+		if strings.HasSuffix(name, ".txt") && !strings.HasSuffix(display, ".txt") {
+			t.Errorf("got %q, want the extension kept", display)
+		}
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	for _, tt := range []struct {
+		disposition string
+		name        string
+		want        string
+	}{
+		{"attachment", "report.pdf", `attachment; filename="report.pdf"`},
+		{"inline", "a b.txt", `inline; filename="a b.txt"`},
+		{"attachment", "caf\u00e9.txt", `attachment; filename="cafe.txt"; filename*=UTF-8''caf%C3%A9.txt`},
+		{"attachment", "\u65e5\u672c.txt", `attachment; filename="__.txt"; filename*=UTF-8''%E6%97%A5%E6%9C%AC.txt`},
+		// quotes and backslashes can not break out of the quoted string
+		{"attachment", `a"b\c.txt`, `attachment; filename="a_b_c.txt"; filename*=UTF-8''a%22b%5Cc.txt`},
+		{"attachment", "x.txt\"; filename=evil.exe", `attachment; filename="x.txt_; filename=evil.exe"; filename*=UTF-8''x.txt%22%3B%20filename%3Devil.exe`},
+		// nor can line breaks start another header
+		{"attachment", "a\r\nSet-Cookie: x", `attachment; filename="a__Set-Cookie: x"; filename*=UTF-8''a%0D%0ASet-Cookie%3A%20x`},
+	} {
+		if got := ContentDisposition(tt.disposition, tt.name); got != tt.want {
+			t.Errorf("ContentDisposition(%q, %q):\ngot  %s\nwant %s", tt.disposition, tt.name, got, tt.want)
+		}
+	}
+}
@@ -2,43 +2,19 @@ package pkg
 
 import (
 	"compress/gzip"
-	"crypto/md5"
-	"encoding/hex"
 	"io"
 	"net/http"
-	"os"
 	"strings"
 	"unicode"
 
 	"github.com/h2non/filetype"
 )
 
-func FileMD5(pathToFile string) (result string, err error) {
-	file, err := os.Open(pathToFile)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
-
-	hash := md5.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return "", err
-	}
-	checksum := hex.EncodeToString(hash.Sum(nil))
-	return checksum, nil
-}
-
-// GetFileContentType returns the MIME content-type of a file.
-func GetFileContentType(filename string) (string, bool, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return "", false, err
-	}
-	defer file.Close()
-	return GetFileContentTypeReader(filename, file)
-}
+// SniffLen is the number of leading bytes needed by DetectContentType.
+const SniffLen = 261
 
-// GetFileContentTypeReader determines the content type from an io.Reader.
+// GetFileContentTypeReader determines the content type from an io.Reader
+// of gzipped data.
 func GetFileContentTypeReader(filename string, reader io.Reader) (contentType string, isaciii bool, err error) {
 	// Open the file
 	gzReader, err := gzip.NewReader(reader)
@@ -48,21 +24,21 @@ func GetFileContentTypeReader(filename string, reader io.Reader) (contentType st
 	defer gzReader.Close()
 
 	// Read the file header for content type detection
-	header := make([]byte, 261)
-	_, err = gzReader.Read(header)
-	if err != nil {
+	header := make([]byte, SniffLen)
+	n, err := io.ReadFull(gzReader, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
 		return "", false, err
 	}
 
-	// Detect content type using the 'filetype' library
-	kind, err := filetype.Match(header)
-	if err != nil {
-		return
-	}
+	contentType, isaciii = DetectContentType(filename, header[:n])
+	return contentType, isaciii, nil
+}
 
-	if err != nil {
-		return
-	}
+// DetectContentType returns the MIME content-type of a file from its first
+// SniffLen bytes and whether those bytes are all ASCII.
+func DetectContentType(filename string, header []byte) (contentType string, isaciii bool) {
+	// Detect content type using the 'filetype' library
+	kind, _ := filetype.Match(header)
 	if kind == filetype.Unknown {
 		contentType = strings.Split(http.DetectContentType(header), ";")[0]
 		if contentType == "application/octet-stream" {
@@ -84,7 +60,7 @@ func GetFileContentTypeReader(filename string, reader io.Reader) (contentType st
 		}
 	}
 	isaciii = isASCII(string(header))
-	return contentType, isaciii, nil
+	return
 }
 
 // isASCII checks if a string is entirely composed of ASCII characters.
@@ -96,3 +72,24 @@ func isASCII(s string) bool {
 	}
 	return true
 }
+
+// activeContentTypes are the content types a browser runs script in when
+// they are opened.
+var activeContentTypes = map[string]bool{
+	"text/html":                true,
+	"application/xhtml+xml":    true,
+	"image/svg+xml":            true,
+	"text/xml":                 true,
+	"application/xml":          true,
+	"text/xsl":                 true,
+	"application/javascript":   true,
+	"text/javascript":          true,
+	"application/x-javascript": true,
+}
+
+// IsActiveContent reports whether data of contentType can run script when
+// it is opened in a browser. Every XML based type can, through XSLT.
+func IsActiveContent(contentType string) bool {
+	contentType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	return activeContentTypes[contentType] || strings.HasSuffix(contentType, "+xml")
+}
@@ -0,0 +1,106 @@
+package pkg
+
+import (
+	"crypto/rand"
+	_ "embed"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/tuilakhanh/webshare/internal/config"
+)
+
+//go:embed words.txt
+var wordList string
+
+// idAlphabets are the named alphabets that can be used for share IDs. Any
+// other value of the alphabet option is used as a literal set of characters.
+var idAlphabets = map[string][]string{
+	"base58": strings.Split("123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz", ""),
+	"digits": strings.Split("0123456789", ""),
+	"hex":    strings.Split("0123456789abcdef", ""),
+	"words":  strings.Fields(wordList),
+}
+
+// reservedIDs can never be handed out because they clash with the routes
+// or with the layout of the storage.
+var reservedIDs = map[string]bool{
+	"1":      true,
+	"api":    true,
+	"auth":   true,
+	"blobs":  true,
+	"delete": true,
+	"exists": true,
+	"files":  true,
+	"my":     true,
+	"static": true,
+}
+
+// IDGenerator creates unguessable share IDs from a crypto random source.
+type IDGenerator struct {
+	symbols   []string
+	length    int
+	separator string
+}
+
+// NewIDGenerator returns the IDGenerator configured by the IDAlphabet and
+// IDLength options. For the "words" alphabet the length is the number of words.
+func NewIDGenerator(config config.Config) (*IDGenerator, error) {
+	if config.IDLength < 1 {
+		return nil, fmt.Errorf("id length must be positive, got %d", config.IDLength)
+	}
+	g := &IDGenerator{length: config.IDLength}
+	if symbols, ok := idAlphabets[config.IDAlphabet]; ok {
+		g.symbols = symbols
+	} else {
+		g.symbols = uniqueSymbols(config.IDAlphabet)
+	}
+	if config.IDAlphabet == "words" {
+		g.separator = "-"
+	}
+	if len(g.symbols) < 2 {
+		return nil, fmt.Errorf("id alphabet %q needs at least two distinct symbols", config.IDAlphabet)
+	}
+	for _, s := range g.symbols {
+		if strings.ContainsAny(s, "/?#%. ") {
+			return nil, fmt.Errorf("id alphabet %q contains characters that are not URL safe", config.IDAlphabet)
+		}
+		// the temporary files of uploads start with "upload_" and are
+		// never taken for shares
+		if strings.Contains(s, "_") {
+			return nil, fmt.Errorf("id alphabet %q must not contain _", config.IDAlphabet)
+		}
+	}
+	return g, nil
+}
+
+// New returns a random ID. It does not check whether the ID is already taken.
+func (g *IDGenerator) New() (string, error) {
+	for {
+		parts := make([]string, g.length)
+		max := big.NewInt(int64(len(g.symbols)))
+		for i := range parts {
+			n, err := rand.Int(rand.Reader, max)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = g.symbols[n.Int64()]
+		}
+		id := strings.Join(parts, g.separator)
+		if !reservedIDs[id] {
+			return id, nil
+		}
+	}
+}
+
+// uniqueSymbols splits a custom alphabet into its distinct characters.
+func uniqueSymbols(alphabet string) (symbols []string) {
+	seen := make(map[rune]bool)
+	for _, r := range alphabet {
+		if !seen[r] {
+			seen[r] = true
+			symbols = append(symbols, string(r))
+		}
+	}
+	return
+}
@@ -0,0 +1,85 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tuilakhanh/webshare/internal/config"
+)
+
+func TestNewIDGenerator(t *testing.T) {
+	for _, tt := range []struct {
+		alphabet string
+		length   int
+		ok       bool
+	}{
+		{"base58", 8, true},
+		{"words", 3, true},
+		{"abc", 4, true},
+		{"base58", 0, false},
+		{"aaaa", 4, false},
+		{"ab/c", 4, false},
+		{"ab.c", 4, false},
+		{"ab c", 4, false},
+		// could hand out IDs of temporary upload files
+		{"adlopu_", 7, false},
+	} {
+		_, err := NewIDGenerator(config.Config{IDAlphabet: tt.alphabet, IDLength: tt.length})
+		if (err == nil) != tt.ok {
+			t.Errorf("NewIDGenerator(%q, %d): got %v, want ok %v", tt.alphabet, tt.length, err, tt.ok)
+		}
+	}
+}
+
+func TestIDGeneratorNew(t *testing.T) {
+	for _, tt := range []struct {
+		alphabet string
+		length   int
+		valid    func(string) bool
+	}{
+		{"base58", 8, func(id string) bool {
+			return len(id) == 8 && !strings.ContainsAny(id, "0OIl")
+		}},
+		{"hex", 12, func(id string) bool {
+			return len(id) == 12 && strings.Trim(id, "0123456789abcdef") == ""
+		}},
+		{"words", 3, func(id string) bool {
+			return len(strings.Split(id, "-")) == 3
+		}},
+		{"xyz", 12, func(id string) bool {
+			return len(id) == 12 && strings.Trim(id, "xyz") == ""
+		}},
+	} {
+		g, err := NewIDGenerator(config.Config{IDAlphabet: tt.alphabet, IDLength: tt.length})
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := make(map[string]bool)
+		for range 100 {
+			id, err := g.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.valid(id) {
+				t.Errorf("%s: invalid ID %q", tt.alphabet, id)
+			}
+			seen[id] = true
+		}
+		if len(seen) < 90 {
+			t.Errorf("%s: only %d distinct IDs out of 100", tt.alphabet, len(seen))
+		}
+	}
+}
+
+// With a single digit out of two, half of the IDs would be the reserved 1.
+func TestIDGeneratorReserved(t *testing.T) {
+	g, err := NewIDGenerator(config.Config{IDAlphabet: "12", IDLength: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 100 {
+		if id, err := g.New(); err != nil || id != "2" {
+			t.Fatalf("New: got %q, %v, want the only free ID 2", id, err)
+		}
+	}
+}
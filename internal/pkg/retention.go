@@ -0,0 +1,156 @@
+package pkg
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tuilakhanh/webshare/internal/config"
+)
+
+// Curve computes how long a file of size bytes is kept under policy, before
+// the minimum and maximum retention are applied.
+type Curve func(size uint64, policy *RetentionPolicy) time.Duration
+
+// Curves are the retention curves that can be selected by name.
+var Curves = map[string]Curve{
+	// inverse keeps files MinutesPerGigabyte minutes per gigabyte, the
+	// smaller a file the longer
+	"inverse": func(size uint64, policy *RetentionPolicy) time.Duration {
+		minutes := policy.MinutesPerGigabyte * 1e9 / float64(max(size, 1))
+		return durationOf(minutes * float64(time.Minute))
+	},
+	// linear goes from the maximum retention for empty files down to the
+	// minimum for files of the maximum size
+	"linear": func(size uint64, policy *RetentionPolicy) time.Duration {
+		span := float64(policy.Max - policy.Min)
+		return policy.Min + durationOf(span*(1-policy.relativeSize(size)))
+	},
+	// cubic is the curve of 0x0.st, which keeps small files close to the
+	// maximum retention and only drops steeply for big files
+	"cubic": func(size uint64, policy *RetentionPolicy) time.Duration {
+		span := float64(policy.Max - policy.Min)
+		return policy.Min + durationOf(span*math.Pow(1-policy.relativeSize(size), 3))
+	},
+}
+
+// RetentionOverride replaces the minimum and maximum retention for the
+// content types starting with ContentType.
+type RetentionOverride struct {
+	ContentType string
+	Min         time.Duration
+	Max         time.Duration
+}
+
+// RetentionPolicy decides how long uploads are kept.
+type RetentionPolicy struct {
+	Curve              Curve
+	MinutesPerGigabyte float64
+	MaxSize            int64
+	Min                time.Duration
+	Max                time.Duration
+	Overrides          []RetentionOverride
+}
+
+// NewRetentionPolicy returns the retention policy described in the config.
+func NewRetentionPolicy(config config.Config) (*RetentionPolicy, error) {
+	curve, ok := Curves[config.RetentionCurve]
+	if !ok {
+		return nil, fmt.Errorf("unknown retention curve %q", config.RetentionCurve)
+	}
+	policy := &RetentionPolicy{
+		Curve:              curve,
+		MinutesPerGigabyte: config.MinutesPerGigabyte,
+		MaxSize:            config.MaxBytesPerFile,
+		Min:                config.MinRetention,
+		Max:                config.MaxRetention,
+	}
+	if policy.Max <= 0 || policy.Min < 0 || policy.Min > policy.Max {
+		return nil, fmt.Errorf("retention must satisfy 0 <= min (%s) <= max (%s)", policy.Min, policy.Max)
+	}
+	for _, entry := range strings.Split(config.RetentionOverrides, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		override, err := parseRetentionOverride(entry)
+		if err != nil {
+			return nil, err
+		}
+		policy.Overrides = append(policy.Overrides, override)
+	}
+	return policy, nil
+}
+
+// parseRetentionOverride parses "type=max" or "type=min..max", where type is
+// a content type prefix like "image/" or "application/pdf". A trailing "*"
+// is allowed, so "image/*" works too.
+func parseRetentionOverride(entry string) (override RetentionOverride, err error) {
+	contentType, bounds, ok := strings.Cut(entry, "=")
+	if !ok || contentType == "" {
+		return override, fmt.Errorf("retention override %q is not type=max or type=min..max", entry)
+	}
+	override.ContentType = strings.TrimSuffix(strings.TrimSpace(contentType), "*")
+	minimum, maximum, ok := strings.Cut(bounds, "..")
+	if !ok {
+		minimum, maximum = "0s", bounds
+	}
+	if override.Min, err = ParseDuration(minimum); err == nil {
+		override.Max, err = ParseDuration(maximum)
+	}
+	if err != nil {
+		return override, fmt.Errorf("retention override %q: %w", entry, err)
+	}
+	if override.Max <= 0 || override.Min > override.Max {
+		return override, fmt.Errorf("retention override %q: min must not exceed max", entry)
+	}
+	return override, nil
+}
+
+// Lifetime returns how long a file is kept at most, from its content type
+// and size.
+func (p *RetentionPolicy) Lifetime(contentType string, size uint64) time.Duration {
+	bounded := *p
+	for _, override := range p.Overrides {
+		if strings.HasPrefix(contentType, override.ContentType) {
+			bounded.Min, bounded.Max = override.Min, override.Max
+			break
+		}
+	}
+	return min(max(bounded.Curve(size, &bounded), bounded.Min), bounded.Max)
+}
+
+// relativeSize returns size as a fraction of the maximum file size.
+func (p *RetentionPolicy) relativeSize(size uint64) float64 {
+	if p.MaxSize <= 0 {
+		return 0
+	}
+	return min(float64(size)/float64(p.MaxSize), 1)
+}
+
+// durationOf converts nanoseconds to a duration without overflowing.
+func durationOf(nanoseconds float64) time.Duration {
+	if nanoseconds >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(nanoseconds)
+}
+
+// ParseDuration parses a duration like time.ParseDuration, but also accepts
+// whole days like "7d".
+func ParseDuration(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		const day = 24 * time.Hour
+		n, err := strconv.ParseInt(days, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		if n > math.MaxInt64/int64(day) || n < math.MinInt64/int64(day) {
+			return 0, fmt.Errorf("duration %q is too long", value)
+		}
+		return time.Duration(n) * day, nil
+	}
+	return time.ParseDuration(value)
+}
@@ -0,0 +1,133 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tuilakhanh/webshare/internal/config"
+)
+
+func TestParseDuration(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"90m", 90 * time.Minute, true},
+		{"1h30m", 90 * time.Minute, true},
+		{"7d", 7 * 24 * time.Hour, true},
+		{"0d", 0, true},
+		{"-1d", -24 * time.Hour, true},
+		{"106751d", 106751 * 24 * time.Hour, true},
+		// would overflow
+		{"106752d", 0, false},
+		{"-106752d", 0, false},
+		{"99999999999999999999d", 0, false},
+		{"1.5d", 0, false},
+		{"d", 0, false},
+		{"7 days", 0, false},
+		{"", 0, false},
+	} {
+		got, err := ParseDuration(tt.value)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseDuration(%q): got %v, %v, want %v, ok %v", tt.value, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRetentionCurves(t *testing.T) {
+	const gb = 1 << 30
+	for _, tt := range []struct {
+		curve string
+		size  uint64
+		want  time.Duration
+	}{
+		// 1440 minutes per gigabyte
+		{"inverse", 1e9, 24 * time.Hour},
+		{"inverse", 2e9, 12 * time.Hour},
+		{"inverse", 1e12, time.Hour},
+		{"inverse", 1, 30 * 24 * time.Hour},
+		{"inverse", 0, 30 * 24 * time.Hour},
+		{"linear", 0, 30 * 24 * time.Hour},
+		{"linear", gb / 2, (30*24 + 1) * time.Hour / 2},
+		{"linear", gb, time.Hour},
+		{"linear", 2 * gb, time.Hour},
+		{"cubic", 0, 30 * 24 * time.Hour},
+		{"cubic", gb / 2, time.Hour + (30*24-1)*time.Hour/8},
+		{"cubic", gb, time.Hour},
+	} {
+		policy, err := NewRetentionPolicy(config.Config{
+			RetentionCurve:     tt.curve,
+			MinutesPerGigabyte: 1440,
+			MaxBytesPerFile:    gb,
+			MinRetention:       time.Hour,
+			MaxRetention:       30 * 24 * time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := policy.Lifetime("text/plain", tt.size); (got - tt.want).Abs() > time.Second {
+			t.Errorf("%s of %d bytes: got %v, want %v", tt.curve, tt.size, got, tt.want)
+		}
+	}
+
+	// the smaller a file, the longer it is kept
+	for name := range Curves {
+		policy, err := NewRetentionPolicy(config.Config{RetentionCurve: name, MinutesPerGigabyte: 60, MaxBytesPerFile: gb, MaxRetention: 365 * 24 * time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := policy.Lifetime("", 0)
+		for size := uint64(1 << 10); size <= 2*gb; size *= 4 {
+			lifetime := policy.Lifetime("", size)
+			if lifetime > last {
+				t.Errorf("%s: %d bytes are kept %v, longer than smaller files (%v)", name, size, lifetime, last)
+			}
+			last = lifetime
+		}
+	}
+}
+
+func TestRetentionOverrides(t *testing.T) {
+	policy, err := NewRetentionPolicy(config.Config{
+		RetentionCurve:     "inverse",
+		MinutesPerGigabyte: 1440,
+		MaxRetention:       30 * 24 * time.Hour,
+		RetentionOverrides: "image/*=7d, application/pdf=2d..60d",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		contentType string
+		size        uint64
+		want        time.Duration
+	}{
+		{"image/png", 1, 7 * 24 * time.Hour},
+		{"application/pdf", 1, 60 * 24 * time.Hour},
+		{"application/pdf", 1e12, 2 * 24 * time.Hour},
+		{"text/plain", 1, 30 * 24 * time.Hour},
+		{"text/plain", 1e12, time.Minute * 1440 / 1000},
+	} {
+		if got := policy.Lifetime(tt.contentType, tt.size); (got - tt.want).Abs() > time.Second {
+			t.Errorf("%s of %d bytes: got %v, want %v", tt.contentType, tt.size, got, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		name string
+		cfg  config.Config
+	}{
+		{"unknown curve", config.Config{RetentionCurve: "square", MaxRetention: time.Hour}},
+		{"no maximum", config.Config{RetentionCurve: "inverse"}},
+		{"minimum above maximum", config.Config{RetentionCurve: "inverse", MinRetention: 2 * time.Hour, MaxRetention: time.Hour}},
+		{"override without type", config.Config{RetentionCurve: "inverse", MaxRetention: time.Hour, RetentionOverrides: "=1d"}},
+		{"override without bounds", config.Config{RetentionCurve: "inverse", MaxRetention: time.Hour, RetentionOverrides: "image/"}},
+		{"override minimum above maximum", config.Config{RetentionCurve: "inverse", MaxRetention: time.Hour, RetentionOverrides: "image/=2d..1d"}},
+		{"override overflowing", config.Config{RetentionCurve: "inverse", MaxRetention: time.Hour, RetentionOverrides: "image/=999999d"}},
+	} {
+		if _, err := NewRetentionPolicy(tt.cfg); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
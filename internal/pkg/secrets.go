@@ -0,0 +1,57 @@
+package pkg
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+// NewSecret returns a random token to hand out to a client along with the
+// hash to store in its place.
+func NewSecret() (token string, hash string, err error) {
+	b := make([]byte, 24)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, HashSecret(token), nil
+}
+
+// HashSecret returns the hash that is stored for token.
+func HashSecret(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// SecretMatches reports in constant time whether token belongs to hash.
+func SecretMatches(token, hash string) bool {
+	if token == "" || hash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(HashSecret(token)), []byte(hash)) == 1
+}
+
+// SignValue appends an HMAC-SHA256 signature of value made with key.
+func SignValue(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return value + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyValue returns the value signed by SignValue if the signature was
+// made with key.
+func VerifyValue(key []byte, signed string) (value string, ok bool) {
+	i := strings.LastIndex(signed, ".")
+	if i < 0 {
+		return "", false
+	}
+	value = signed[:i]
+	if !hmac.Equal([]byte(SignValue(key, value)), []byte(signed)) {
+		return "", false
+	}
+	return value, true
+}
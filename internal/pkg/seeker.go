@@ -0,0 +1,77 @@
+package pkg
+
+import (
+	"errors"
+	"io"
+)
+
+// Seeker provides io.ReadSeekCloser on top of a stream that can only be read
+// from the start, like gzipped data. Seeking forward skips over the data,
+// seeking backwards opens the stream again. Nothing is read until the first
+// call to Read, so seeking around to find the size is cheap.
+type Seeker struct {
+	open   func() (io.ReadCloser, error)
+	size   int64
+	offset int64 // position seeked to
+	pos    int64 // position of r
+	r      io.ReadCloser
+}
+
+// NewSeeker returns a Seeker over the size bytes returned by open.
+func NewSeeker(open func() (io.ReadCloser, error), size int64) *Seeker {
+	return &Seeker{open: open, size: size}
+}
+
+func (s *Seeker) Read(p []byte) (n int, err error) {
+	if s.offset >= s.size {
+		return 0, io.EOF
+	}
+	if s.r != nil && s.pos > s.offset {
+		s.r.Close()
+		s.r = nil
+	}
+	if s.r == nil {
+		if s.r, err = s.open(); err != nil {
+			s.r = nil
+			return
+		}
+		s.pos = 0
+	}
+	if s.pos < s.offset {
+		skipped, err := io.CopyN(io.Discard, s.r, s.offset-s.pos)
+		s.pos += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err = s.r.Read(p)
+	s.pos += int64(n)
+	s.offset += int64(n)
+	return
+}
+
+func (s *Seeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, errors.New("seeker: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("seeker: negative position")
+	}
+	s.offset = offset
+	return offset, nil
+}
+
+func (s *Seeker) Close() error {
+	if s.r == nil {
+		return nil
+	}
+	err := s.r.Close()
+	s.r = nil
+	return err
+}
@@ -0,0 +1,493 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Encrypted objects are encrypted with a random key of their own, which is
+// stored in the header of the object wrapped with a master key:
+//
+//	magic     8 bytes  "\x89WSENC\r\n"
+//	key ID    8 bytes  start of the SHA-256 of the master key
+//	nonce    24 bytes  XChaCha20-Poly1305 nonce of the wrapped key
+//	key      48 bytes  the object key sealed with the master key
+//	chunks             up to 64 KiB of data each, sealed with the object key
+//
+// The data is sealed with ChaCha20-Poly1305 in chunks, so it can be decrypted
+// while it is streamed and seeked in. The nonce of a chunk is its number with
+// the last byte set for the final chunk, so chunks can neither be reordered
+// nor cut off (the STREAM construction).
+const (
+	encChunkSize  = 64 << 10
+	encSealedSize = encChunkSize + chacha20poly1305.Overhead
+	encKeyIDSize  = 8
+	encHeaderSize = len(encMagic) + encKeyIDSize + chacha20poly1305.NonceSizeX + chacha20poly1305.KeySize + chacha20poly1305.Overhead
+)
+
+const encMagic = "\x89WSENC\r\n"
+
+// ErrDecrypt is returned when an object was tampered with or is encrypted
+// with a master key that is not in the keyring.
+var ErrDecrypt = errors.New("storage: object can not be decrypted")
+
+// ErrNotEncrypted is returned for objects stored without encryption, unless
+// they may be read as they are.
+var ErrNotEncrypted = fmt.Errorf("%w: object is not encrypted", ErrDecrypt)
+
+type masterKey struct {
+	id   []byte
+	aead cipher.AEAD
+	// nameKey keys the hashes names are derived from
+	nameKey []byte
+}
+
+// Keyring holds the master keys. The first one wraps the keys of new
+// objects, the others only unwrap the keys of objects stored before the
+// keys were rotated.
+type Keyring struct {
+	keys []masterKey
+}
+
+// ParseKeyring parses master keys of 32 bytes, written as hex or base64 and
+// separated by commas or new lines. Lines starting with # are ignored.
+func ParseKeyring(s string) (*Keyring, error) {
+	k := new(Keyring)
+	for _, line := range strings.Split(s, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		for _, field := range strings.Split(line, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			key, err := hex.DecodeString(field)
+			if err != nil {
+				key, err = base64.StdEncoding.DecodeString(field)
+			}
+			if err != nil || len(key) != chacha20poly1305.KeySize {
+				return nil, errors.New("encryption keys must be 32 bytes in hex or base64")
+			}
+			aead, err := chacha20poly1305.NewX(key)
+			if err != nil {
+				return nil, err
+			}
+			sum := sha256.Sum256(key)
+			mac := hmac.New(sha256.New, key)
+			mac.Write([]byte("webshare names"))
+			k.keys = append(k.keys, masterKey{id: sum[:encKeyIDSize], aead: aead, nameKey: mac.Sum(nil)})
+		}
+	}
+	if len(k.keys) == 0 {
+		return nil, errors.New("no encryption key given")
+	}
+	return k, nil
+}
+
+// wrap returns the header of a new object encrypted with objectKey.
+func (k *Keyring) wrap(objectKey []byte) ([]byte, error) {
+	current := k.keys[0]
+	header := make([]byte, 0, encHeaderSize)
+	header = append(header, encMagic...)
+	header = append(header, current.id...)
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header = append(header, nonce...)
+	// the magic and the key ID are authenticated along with the key
+	return current.aead.Seal(header, nonce, objectKey, header[:len(encMagic)+encKeyIDSize]), nil
+}
+
+// unwrap returns the object key stored in header, and whether it is wrapped
+// with the current master key.
+func (k *Keyring) unwrap(header []byte) (objectKey []byte, current bool, err error) {
+	id := header[len(encMagic) : len(encMagic)+encKeyIDSize]
+	nonce := header[len(encMagic)+encKeyIDSize : len(encMagic)+encKeyIDSize+chacha20poly1305.NonceSizeX]
+	sealed := header[len(encMagic)+encKeyIDSize+chacha20poly1305.NonceSizeX:]
+	for i, master := range k.keys {
+		if !bytes.Equal(master.id, id) {
+			continue
+		}
+		objectKey, err := master.aead.Open(nil, nonce, sealed, header[:len(encMagic)+encKeyIDSize])
+		if err != nil {
+			return nil, false, ErrDecrypt
+		}
+		return objectKey, i == 0, nil
+	}
+	return nil, false, fmt.Errorf("%w: unknown master key %x", ErrDecrypt, id)
+}
+
+// Seal encrypts a small value that is kept outside of the storage, such as
+// the meta information in the index, with the current master key:
+//
+//	key ID    8 bytes
+//	nonce    24 bytes
+//	value             sealed with the master key
+func (k *Keyring) Seal(value []byte) ([]byte, error) {
+	current := k.keys[0]
+	sealed := make([]byte, 0, encKeyIDSize+chacha20poly1305.NonceSizeX+len(value)+chacha20poly1305.Overhead)
+	sealed = append(sealed, current.id...)
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed = append(sealed, nonce...)
+	return current.aead.Seal(sealed, nonce, value, current.id), nil
+}
+
+// Open decrypts a value sealed with Seal by any of the master keys.
+func (k *Keyring) Open(sealed []byte) ([]byte, error) {
+	if len(sealed) < encKeyIDSize+chacha20poly1305.NonceSizeX {
+		return nil, ErrDecrypt
+	}
+	id := sealed[:encKeyIDSize]
+	nonce := sealed[encKeyIDSize : encKeyIDSize+chacha20poly1305.NonceSizeX]
+	for _, master := range k.keys {
+		if bytes.Equal(master.id, id) {
+			value, err := master.aead.Open(nil, nonce, sealed[encKeyIDSize+chacha20poly1305.NonceSizeX:], id)
+			if err != nil {
+				return nil, ErrDecrypt
+			}
+			return value, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: unknown master key %x", ErrDecrypt, id)
+}
+
+// Name returns a name for an object derived from data, such as its hash,
+// that only tells who has the current master key what data it is derived
+// from.
+func (k *Keyring) Name(data []byte) string {
+	mac := hmac.New(sha256.New, k.keys[0].nameKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CurrentID returns the ID of the master key new objects are encrypted
+// with, in hex.
+func (k *Keyring) CurrentID() string {
+	return hex.EncodeToString(k.keys[0].id)
+}
+
+// Keys returns the keyring the objects are encrypted with.
+func (e *Encrypted) Keys() *Keyring {
+	return e.keys
+}
+
+// Encrypted encrypts every object on its way into the wrapped storage and
+// decrypts it on its way out. Objects stored before encryption was enabled
+// can not be read until RotateKeys encrypts them, unless ReadUnencrypted is
+// set. Otherwise anyone who can write to the storage could slip in objects
+// that are served as if they had been encrypted.
+type Encrypted struct {
+	Storage
+	keys *Keyring
+	// ReadUnencrypted lets Get return objects stored without encryption as
+	// they are, while the storage is migrated.
+	ReadUnencrypted bool
+}
+
+// NewEncrypted returns a Storage that encrypts the objects stored in store
+// with the master keys in keys.
+func NewEncrypted(store Storage, keys *Keyring) *Encrypted {
+	return &Encrypted{Storage: store, keys: keys}
+}
+
+// Put returns the number of bytes stored, which includes the header and the
+// authentication tags.
+func (e *Encrypted) Put(key string, r io.Reader) (int64, error) {
+	objectKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(objectKey); err != nil {
+		return 0, err
+	}
+	header, err := e.keys.wrap(objectKey)
+	if err != nil {
+		return 0, err
+	}
+	aead, err := chacha20poly1305.New(objectKey)
+	if err != nil {
+		return 0, err
+	}
+	sealed := &encryptReader{src: bufio.NewReader(r), aead: aead, plain: make([]byte, encChunkSize)}
+	return e.Storage.Put(key, io.MultiReader(bytes.NewReader(header), sealed))
+}
+
+// Get returns a reader that can seek if the wrapped storage can.
+func (e *Encrypted) Get(key string) (io.ReadCloser, error) {
+	f, err := e.Storage.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, encHeaderSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		f.Close()
+		return nil, err
+	}
+	if n < encHeaderSize || string(header[:len(encMagic)]) != encMagic {
+		// stored before encryption was enabled
+		if !e.ReadUnencrypted {
+			f.Close()
+			return nil, ErrNotEncrypted
+		}
+		if s, ok := f.(io.Seeker); ok {
+			if _, err := s.Seek(0, io.SeekStart); err != nil {
+				f.Close()
+				return nil, err
+			}
+			return f, nil
+		}
+		return readCloser{io.MultiReader(bytes.NewReader(header[:n]), f), f}, nil
+	}
+	objectKey, _, err := e.keys.unwrap(header)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(objectKey)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	d := &decryptReader{
+		file:   f,
+		src:    bufio.NewReaderSize(f, encSealedSize+1),
+		aead:   aead,
+		sealed: make([]byte, encSealedSize),
+		plain:  make([]byte, 0, encChunkSize),
+	}
+	if s, ok := f.(io.Seeker); ok {
+		return &seekableDecryptReader{decryptReader: d, seeker: s, size: -1}, nil
+	}
+	return d, nil
+}
+
+// RotateKeys wraps the key of every object with the first master key, and
+// encrypts the objects stored before encryption was enabled. The data of
+// encrypted objects is copied as it is. It returns the number of objects
+// that were rewritten. It can run while a server uses the storage, but an
+// object the server replaces in the moment it is rewritten goes back to
+// its older content.
+func (e *Encrypted) RotateKeys() (rewritten int, err error) {
+	err = e.Storage.Walk("", func(info ObjectInfo) error {
+		ok, err := e.rotate(info.Key)
+		if errors.Is(err, ErrNotExist) {
+			// deleted in the meantime
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", info.Key, err)
+		}
+		if ok {
+			rewritten++
+		}
+		return nil
+	})
+	return
+}
+
+func (e *Encrypted) rotate(key string) (bool, error) {
+	f, err := e.Storage.Get(key)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	header := make([]byte, encHeaderSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+	if n < encHeaderSize || string(header[:len(encMagic)]) != encMagic {
+		_, err := e.Put(key, io.MultiReader(bytes.NewReader(header[:n]), f))
+		return err == nil, err
+	}
+	objectKey, current, err := e.keys.unwrap(header)
+	if err != nil || current {
+		return false, err
+	}
+	header, err = e.keys.wrap(objectKey)
+	if err != nil {
+		return false, err
+	}
+	_, err = e.Storage.Put(key, io.MultiReader(bytes.NewReader(header), f))
+	return err == nil, err
+}
+
+// chunkNonce returns the nonce of chunk number n.
+func chunkNonce(n uint64, final bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[chacha20poly1305.NonceSize-9:], n)
+	if final {
+		nonce[chacha20poly1305.NonceSize-1] = 1
+	}
+	return nonce
+}
+
+// encryptReader reads the chunks sealed from the data read from src.
+type encryptReader struct {
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	counter uint64
+	plain   []byte
+	buf     []byte
+	// sealed is what is left of the current chunk
+	sealed []byte
+	done   bool
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.sealed) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.seal(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.sealed)
+	e.sealed = e.sealed[n:]
+	return n, nil
+}
+
+// seal seals the next chunk. A full chunk is only final if nothing follows,
+// so only empty data ends with an empty chunk.
+func (e *encryptReader) seal() error {
+	n, err := io.ReadFull(e.src, e.plain)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		e.done = true
+	} else if err != nil {
+		return err
+	} else if _, err := e.src.Peek(1); errors.Is(err, io.EOF) {
+		e.done = true
+	} else if err != nil {
+		return err
+	}
+	e.buf = e.aead.Seal(e.buf[:0], chunkNonce(e.counter, e.done), e.plain[:n], nil)
+	e.sealed = e.buf
+	e.counter++
+	return nil
+}
+
+// decryptReader decrypts the chunks read from src.
+type decryptReader struct {
+	file    io.ReadCloser
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	counter uint64
+	sealed  []byte
+	// plain is the current chunk, which starts at offset start of the data
+	plain []byte
+	start int64
+	pos   int
+	final bool
+	err   error
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for d.pos >= len(d.plain) {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.final {
+			return 0, io.EOF
+		}
+		d.err = d.open()
+	}
+	n := copy(p, d.plain[d.pos:])
+	d.pos += n
+	return n, nil
+}
+
+// open decrypts the next chunk.
+func (d *decryptReader) open() error {
+	n, err := io.ReadFull(d.src, d.sealed)
+	final := false
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		final = true
+	} else if err != nil {
+		return err
+	} else if _, err := d.src.Peek(1); errors.Is(err, io.EOF) {
+		final = true
+	} else if err != nil {
+		return err
+	}
+	plain, err := d.aead.Open(d.plain[:0], chunkNonce(d.counter, final), d.sealed[:n], nil)
+	if err != nil {
+		return ErrDecrypt
+	}
+	d.start = int64(d.counter) * encChunkSize
+	d.plain, d.pos, d.final = plain, 0, final
+	d.counter++
+	return nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.file.Close()
+}
+
+// seekableDecryptReader seeks to the chunk holding the offset and decrypts
+// it, instead of everything before.
+type seekableDecryptReader struct {
+	*decryptReader
+	seeker io.Seeker
+	// size of the data, -1 until it is needed
+	size int64
+}
+
+func (s *seekableDecryptReader) Seek(offset int64, whence int) (int64, error) {
+	if s.size < 0 {
+		end, err := s.seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+		chunks := (end - int64(encHeaderSize) + encSealedSize - 1) / encSealedSize
+		s.size = end - int64(encHeaderSize) - chunks*chacha20poly1305.Overhead
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.start + int64(s.pos)
+	case io.SeekEnd:
+		offset += s.size
+	}
+	if offset < 0 {
+		return 0, errors.New("storage: negative position")
+	}
+
+	chunk := offset / encChunkSize
+	s.plain, s.pos, s.err = s.plain[:0], 0, nil
+	if offset >= s.size {
+		// reads return io.EOF from here on
+		s.start, s.final = offset, true
+		return offset, nil
+	}
+	if _, err := s.seeker.Seek(int64(encHeaderSize)+chunk*encSealedSize, io.SeekStart); err != nil {
+		return 0, err
+	}
+	s.src.Reset(s.file)
+	s.counter, s.final = uint64(chunk), false
+	if err := s.open(); err != nil {
+		return 0, err
+	}
+	s.pos = int(offset - s.start)
+	return offset, nil
+}
+
+// readCloser closes the object after reading it through r.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Local stores the objects as plain files below a directory on disk.
+type Local struct {
+	dir string
+}
+
+// NewLocal returns a Storage rooted at dir, creating it if needed.
+func NewLocal(dir string) (*Local, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &Local{dir: dir}, nil
+}
+
+// path converts key into a file path that can never escape the root.
+func (l *Local) path(key string) string {
+	return filepath.Join(l.dir, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+func (l *Local) Put(key string, r io.Reader) (n int64, err error) {
+	dest := l.path(key)
+
+	// write next to the destination first so readers never see a partial file
+	tempFile, err := os.CreateTemp(l.dir, "upload_")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tempFile.Name())
+
+	n, err = io.Copy(tempFile, r)
+	if err != nil {
+		tempFile.Close()
+		return
+	}
+	if err = tempFile.Close(); err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return
+	}
+	err = os.Rename(tempFile.Name(), dest)
+	return
+}
+
+func (l *Local) Get(key string) (io.ReadCloser, error) {
+	f, err := os.Open(l.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotExist
+	}
+	return f, err
+}
+
+func (l *Local) Stat(key string) (info ObjectInfo, err error) {
+	fi, err := os.Stat(l.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return info, ErrNotExist
+	} else if err != nil {
+		return
+	}
+	info = ObjectInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}
+	return
+}
+
+func (l *Local) Delete(key string) error {
+	p := l.path(key)
+	if p == filepath.Clean(l.dir) {
+		return errors.New("storage: refusing to delete the root")
+	}
+	if _, err := os.Lstat(p); errors.Is(err, fs.ErrNotExist) {
+		return ErrNotExist
+	}
+	return os.RemoveAll(p)
+}
+
+func (l *Local) Move(src string, dst string) error {
+	if _, err := os.Stat(l.path(src)); errors.Is(err, fs.ErrNotExist) {
+		return ErrNotExist
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path(dst)), os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(l.path(src), l.path(dst))
+}
+
+func (l *Local) List(prefix string) (names []string, err error) {
+	entries, err := os.ReadDir(l.path(prefix))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return
+}
+
+func (l *Local) Walk(prefix string, fn func(ObjectInfo) error) error {
+	root := l.path(prefix)
+	err := filepath.Walk(root, func(pathName string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(l.dir, pathName)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, "upload_") {
+			// temporary files of uploads that are still in progress
+			return nil
+		}
+		return fn(ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory keeps every object in memory. It is meant for tests and for
+// throwaway instances.
+type Memory struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemory returns an empty in-memory Storage.
+func NewMemory() *Memory {
+	return &Memory{objects: make(map[string]memoryObject)}
+}
+
+func cleanKey(key string) string {
+	return strings.TrimPrefix(path.Clean("/"+key), "/")
+}
+
+// below reports whether key is prefix itself or lies under it.
+func below(key, prefix string) bool {
+	return prefix == "" || key == prefix || strings.HasPrefix(key, prefix+"/")
+}
+
+func (m *Memory) Put(key string, r io.Reader) (int64, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[cleanKey(key)] = memoryObject{data: b, modTime: time.Now()}
+	return int64(len(b)), nil
+}
+
+func (m *Memory) Get(key string) (io.ReadCloser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	o, ok := m.objects[cleanKey(key)]
+	if !ok {
+		return nil, ErrNotExist
+	}
+	return memoryReader{bytes.NewReader(o.data)}, nil
+}
+
+// memoryReader lets readers of the in-memory objects seek.
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (memoryReader) Close() error { return nil }
+
+func (m *Memory) Stat(key string) (ObjectInfo, error) {
+	key = cleanKey(key)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	o, ok := m.objects[key]
+	if !ok {
+		return ObjectInfo{}, ErrNotExist
+	}
+	return ObjectInfo{Key: key, Size: int64(len(o.data)), ModTime: o.modTime}, nil
+}
+
+func (m *Memory) Delete(key string) error {
+	key = cleanKey(key)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	found := false
+	for k := range m.objects {
+		if below(k, key) {
+			delete(m.objects, k)
+			found = true
+		}
+	}
+	if !found {
+		return ErrNotExist
+	}
+	return nil
+}
+
+func (m *Memory) Move(src string, dst string) error {
+	src, dst = cleanKey(src), cleanKey(dst)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o, ok := m.objects[src]
+	if !ok {
+		return ErrNotExist
+	}
+	delete(m.objects, src)
+	m.objects[dst] = o
+	return nil
+}
+
+func (m *Memory) List(prefix string) ([]string, error) {
+	prefix = cleanKey(prefix)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	seen := make(map[string]bool)
+	for k := range m.objects {
+		if k == prefix || !below(k, prefix) {
+			continue
+		}
+		rest := k
+		if prefix != "" {
+			rest = strings.TrimPrefix(k, prefix+"/")
+		}
+		seen[strings.SplitN(rest, "/", 2)[0]] = true
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *Memory) Walk(prefix string, fn func(ObjectInfo) error) error {
+	prefix = cleanKey(prefix)
+	m.mu.RLock()
+	var infos []ObjectInfo
+	for k, o := range m.objects {
+		if below(k, prefix) {
+			infos = append(infos, ObjectInfo{Key: k, Size: int64(len(o.data)), ModTime: o.modTime})
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Options configures the connection to an S3-compatible object storage.
+type S3Options struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	Insecure  bool
+}
+
+// S3 stores the objects in a bucket of an S3-compatible object storage
+// (AWS S3, MinIO, Ceph, ...). Every key is stored below the configured
+// prefix.
+type S3 struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// s3PartSize is the size of the parts used for uploads of unknown size.
+// minio-go would otherwise size its buffers for 5TiB objects.
+const s3PartSize = 16 << 20
+
+// NewS3 connects to the object storage and makes sure the bucket exists.
+func NewS3(opts S3Options) (*S3, error) {
+	var creds *credentials.Credentials
+	if opts.AccessKey != "" {
+		creds = credentials.NewStaticV4(opts.AccessKey, opts.SecretKey, "")
+	} else {
+		creds = credentials.NewEnvAWS()
+	}
+	client, err := minio.New(opts.Endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: !opts.Insecure,
+		Region: opts.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, opts.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, opts.Bucket, minio.MakeBucketOptions{Region: opts.Region}); err != nil {
+			return nil, err
+		}
+	}
+	return &S3{client: client, bucket: opts.Bucket, prefix: strings.Trim(opts.Prefix, "/")}, nil
+}
+
+// objectName converts key into the name of the object in the bucket.
+func (s *S3) objectName(key string) string {
+	return strings.TrimPrefix(path.Join(s.prefix, cleanKey(key)), "/")
+}
+
+// key converts the name of an object in the bucket back into a key.
+func (s *S3) key(objectName string) string {
+	if s.prefix == "" {
+		return objectName
+	}
+	return strings.TrimPrefix(objectName, s.prefix+"/")
+}
+
+// listPrefix returns the object name prefix of everything below key.
+func (s *S3) listPrefix(key string) string {
+	p := s.objectName(key)
+	if p == "" {
+		return ""
+	}
+	return p + "/"
+}
+
+func s3Error(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NotFound":
+		return ErrNotExist
+	}
+	return err
+}
+
+func (s *S3) Put(key string, r io.Reader) (int64, error) {
+	info, err := s.client.PutObject(context.Background(), s.bucket, s.objectName(key), r, -1,
+		minio.PutObjectOptions{PartSize: s3PartSize})
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+func (s *S3) Get(key string) (io.ReadCloser, error) {
+	obj, err := s.client.GetObject(context.Background(), s.bucket, s.objectName(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	// GetObject is lazy, so stat it to report missing objects right away
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, s3Error(err)
+	}
+	return obj, nil
+}
+
+func (s *S3) Stat(key string) (ObjectInfo, error) {
+	info, err := s.client.StatObject(context.Background(), s.bucket, s.objectName(key), minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, s3Error(err)
+	}
+	return ObjectInfo{Key: cleanKey(key), Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (s *S3) Delete(key string) error {
+	if s.objectName(key) == s.prefix {
+		return errors.New("storage: refusing to delete the root")
+	}
+	ctx := context.Background()
+
+	found := false
+	if _, err := s.client.StatObject(ctx, s.bucket, s.objectName(key), minio.StatObjectOptions{}); err == nil {
+		found = true
+		if err := s.client.RemoveObject(ctx, s.bucket, s.objectName(key), minio.RemoveObjectOptions{}); err != nil {
+			return err
+		}
+	} else if !errors.Is(s3Error(err), ErrNotExist) {
+		return err
+	}
+
+	var below []minio.ObjectInfo
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.listPrefix(key), Recursive: true}) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		below = append(below, obj)
+	}
+	if !found && len(below) == 0 {
+		return ErrNotExist
+	}
+
+	objects := make(chan minio.ObjectInfo, len(below))
+	for _, obj := range below {
+		objects <- obj
+	}
+	close(objects)
+	var err error
+	for result := range s.client.RemoveObjects(ctx, s.bucket, objects, minio.RemoveObjectsOptions{}) {
+		if result.Err != nil && err == nil {
+			err = result.Err
+		}
+	}
+	return err
+}
+
+// Move copies the object inside the bucket, S3 has no rename. Objects over
+// 5 GiB, the most a single copy can take, are copied in parts.
+func (s *S3) Move(src string, dst string) error {
+	ctx := context.Background()
+	_, err := s.client.ComposeObject(ctx,
+		minio.CopyDestOptions{Bucket: s.bucket, Object: s.objectName(dst)},
+		minio.CopySrcOptions{Bucket: s.bucket, Object: s.objectName(src)})
+	if err != nil {
+		return s3Error(err)
+	}
+	return s.client.RemoveObject(ctx, s.bucket, s.objectName(src), minio.RemoveObjectOptions{})
+}
+
+func (s *S3) List(prefix string) (names []string, err error) {
+	listPrefix := s.listPrefix(prefix)
+	for obj := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{Prefix: listPrefix}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		names = append(names, strings.TrimSuffix(strings.TrimPrefix(obj.Key, listPrefix), "/"))
+	}
+	return
+}
+
+func (s *S3) Walk(prefix string, fn func(ObjectInfo) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.listPrefix(prefix), Recursive: true}) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		if err := fn(ObjectInfo{Key: s.key(obj.Key), Size: obj.Size, ModTime: obj.LastModified}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,362 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-process stand-in for an S3-compatible object storage. It
+// knows a single bucket and just enough of the API for the S3 backend:
+// path-style requests, multipart uploads, copies, listings and deletes.
+// Signatures are not checked.
+type fakeS3 struct {
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	uploads map[string]map[int][]byte
+	nextID  int
+}
+
+type fakeObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func (o fakeObject) etag() string {
+	sum := md5.Sum(o.data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{bucket: bucket, objects: make(map[string]fakeObject), uploads: make(map[string]map[int][]byte)}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	q := r.URL.Query()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case key == "" && r.Method == http.MethodHead, key == "" && r.Method == http.MethodPut:
+		w.WriteHeader(http.StatusOK)
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, q.Get("prefix"), q.Get("delimiter"))
+	case key == "" && r.Method == http.MethodPost && q.Has("delete"):
+		f.deleteObjects(w, r)
+	case key == "":
+		fakeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = make(map[int][]byte)
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: id})
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		f.uploadPart(w, r, q)
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		f.completeUpload(w, r, key, q.Get("uploadId"))
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		delete(f.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		src, ok := f.copySource(r)
+		if !ok {
+			fakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		o := fakeObject{data: src.data, modTime: time.Now()}
+		f.objects[key] = o
+		writeXML(w, struct {
+			XMLName      xml.Name `xml:"CopyObjectResult"`
+			ETag         string
+			LastModified time.Time
+		}{ETag: o.etag(), LastModified: o.modTime})
+	case r.Method == http.MethodPut:
+		data, err := readBody(r)
+		if err != nil {
+			fakeS3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		o := fakeObject{data: data, modTime: time.Now()}
+		f.objects[key] = o
+		w.Header().Set("ETag", o.etag())
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		o, ok := f.objects[key]
+		if !ok {
+			fakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", o.etag())
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", o.modTime, bytes.NewReader(o.data))
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fakeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// copySource returns the object named in X-Amz-Copy-Source.
+func (f *fakeS3) copySource(r *http.Request) (fakeObject, bool) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		return fakeObject{}, false
+	}
+	source, _, _ = strings.Cut(source, "?")
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	o, ok := f.objects[key]
+	return o, ok && bucket == f.bucket
+}
+
+func (f *fakeS3) uploadPart(w http.ResponseWriter, r *http.Request, q url.Values) {
+	parts, ok := f.uploads[q.Get("uploadId")]
+	number, err := strconv.Atoi(q.Get("partNumber"))
+	if !ok || err != nil {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	if r.Header.Get("X-Amz-Copy-Source") == "" {
+		data, err := readBody(r)
+		if err != nil {
+			fakeS3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		parts[number] = data
+		w.Header().Set("ETag", fakeObject{data: data}.etag())
+		return
+	}
+
+	src, ok := f.copySource(r)
+	if !ok {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	data := src.data
+	if rng, ok := strings.CutPrefix(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes="); ok {
+		first, last, _ := strings.Cut(rng, "-")
+		start, err1 := strconv.Atoi(first)
+		end, err2 := strconv.Atoi(last)
+		if err1 != nil || err2 != nil || start > end || end >= len(data) {
+			fakeS3Error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		data = data[start : end+1]
+	}
+	parts[number] = data
+	writeXML(w, struct {
+		XMLName      xml.Name `xml:"CopyPartResult"`
+		ETag         string
+		LastModified time.Time
+	}{ETag: fakeObject{data: data}.etag(), LastModified: time.Now()})
+}
+
+func (f *fakeS3) completeUpload(w http.ResponseWriter, r *http.Request, key string, id string) {
+	parts, ok := f.uploads[id]
+	if !ok {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	var complete struct {
+		Parts []struct {
+			PartNumber int
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&complete); err != nil {
+		fakeS3Error(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	var data []byte
+	for _, part := range complete.Parts {
+		b, ok := parts[part.PartNumber]
+		if !ok {
+			fakeS3Error(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		data = append(data, b...)
+	}
+	delete(f.uploads, id)
+	o := fakeObject{data: data, modTime: time.Now()}
+	f.objects[key] = o
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Bucket: f.bucket, Key: key, ETag: o.etag()})
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string, delimiter string) {
+	type content struct {
+		Key          string
+		LastModified time.Time
+		ETag         string
+		Size         int
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	result := struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Name           string
+		Prefix         string
+		KeyCount       int
+		IsTruncated    bool
+		Contents       []content
+		CommonPrefixes []commonPrefix
+	}{Name: f.bucket, Prefix: prefix}
+
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		rest, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			if p := prefix + rest[:i+len(delimiter)]; !seen[p] {
+				seen[p] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{p})
+			}
+			continue
+		}
+		o := f.objects[key]
+		result.Contents = append(result.Contents, content{key, o.modTime, o.etag(), len(o.data)})
+	}
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+	writeXML(w, result)
+}
+
+func (f *fakeS3) deleteObjects(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Objects []struct {
+			Key string
+		} `xml:"Object"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+		fakeS3Error(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	type deleted struct {
+		Key string
+	}
+	result := struct {
+		XMLName xml.Name  `xml:"DeleteResult"`
+		Deleted []deleted `xml:"Deleted"`
+	}{}
+	for _, o := range request.Objects {
+		delete(f.objects, o.Key)
+		result.Deleted = append(result.Deleted, deleted{o.Key})
+	}
+	writeXML(w, result)
+}
+
+// readBody returns the body of an upload, decoding the aws-chunked encoding
+// of streaming signatures.
+func readBody(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+	var data []byte
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		n, err := strconv.ParseInt(size, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			// what follows are trailing checksums at most
+			return data, nil
+		}
+		chunk := make([]byte, n+2)
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk[:n]...)
+	}
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+func fakeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s<Error><Code>%s</Code><Message>%s</Message></Error>", xml.Header, code, code)
+}
+
+func newTestS3(t *testing.T, prefix string) (*S3, *fakeS3) {
+	t.Helper()
+	fake := newFakeS3("webshare")
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	s, err := NewS3(S3Options{
+		Endpoint:  strings.TrimPrefix(server.URL, "http://"),
+		Region:    "us-east-1",
+		Bucket:    "webshare",
+		Prefix:    prefix,
+		AccessKey: "access",
+		SecretKey: "secret",
+		Insecure:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, fake
+}
+
+func TestS3(t *testing.T) {
+	s, _ := newTestS3(t, "")
+	testStorage(t, s)
+}
+
+func TestS3Prefix(t *testing.T) {
+	s, fake := newTestS3(t, "shares/")
+	testStorage(t, s)
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for key := range fake.objects {
+		if !strings.HasPrefix(key, "shares/") {
+			t.Errorf("object %q is stored outside of the prefix", key)
+		}
+	}
+}
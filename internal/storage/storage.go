@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotExist is returned when the requested key is not in the storage.
+var ErrNotExist = errors.New("storage: object does not exist")
+
+// ObjectInfo describes a single stored object
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage is where the uploaded blobs and their metadata are kept. Keys are
+// slash separated, e.g. "<id>/<name>" for the data and "<id>/<id>.json.gz"
+// for the meta information.
+type Storage interface {
+	// Put stores everything read from r under key, replacing whatever was
+	// there before, and returns the number of bytes written.
+	Put(key string, r io.Reader) (int64, error)
+	// Get opens the object stored under key.
+	Get(key string) (io.ReadCloser, error)
+	// Stat returns the info of the object stored under key.
+	Stat(key string) (ObjectInfo, error)
+	// Delete removes key and everything stored below it.
+	Delete(key string) error
+	// Move renames the object stored under src to dst, replacing whatever
+	// was stored under dst, without sending the data through the server.
+	Move(src string, dst string) error
+	// List returns the names of the entries directly below prefix.
+	List(prefix string) ([]string, error)
+	// Walk calls fn for every object stored below prefix.
+	Walk(prefix string, fn func(ObjectInfo) error) error
+}
+
+// Exists reports whether key is in the storage.
+func Exists(s Storage, key string) (bool, error) {
+	_, err := s.Stat(key)
+	if errors.Is(err, ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
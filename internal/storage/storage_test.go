@@ -0,0 +1,387 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// testStorage checks that s behaves the way the handlers expect every
+// backend to. s must be empty.
+func testStorage(t *testing.T, s Storage) {
+	t.Helper()
+
+	t.Run("missing", func(t *testing.T) {
+		if _, err := s.Get("missing/key"); !errors.Is(err, ErrNotExist) {
+			t.Errorf("Get: got %v, want ErrNotExist", err)
+		}
+		if _, err := s.Stat("missing/key"); !errors.Is(err, ErrNotExist) {
+			t.Errorf("Stat: got %v, want ErrNotExist", err)
+		}
+		if err := s.Delete("missing"); !errors.Is(err, ErrNotExist) {
+			t.Errorf("Delete: got %v, want ErrNotExist", err)
+		}
+		if err := s.Move("missing/key", "other/key"); !errors.Is(err, ErrNotExist) {
+			t.Errorf("Move: got %v, want ErrNotExist", err)
+		}
+		if names, err := s.List("missing"); err != nil || len(names) != 0 {
+			t.Errorf("List: got %v, %v, want nothing", names, err)
+		}
+		if keys := walk(t, s, "missing"); len(keys) != 0 {
+			t.Errorf("Walk: got %v, want nothing", keys)
+		}
+	})
+
+	t.Run("put and get", func(t *testing.T) {
+		n, err := s.Put("a/b.txt", strings.NewReader("hello"))
+		if err != nil || n != 5 {
+			t.Fatalf("Put: got %d, %v, want 5 bytes", n, err)
+		}
+		if got := get(t, s, "a/b.txt"); got != "hello" {
+			t.Errorf("Get: got %q, want %q", got, "hello")
+		}
+		info, err := s.Stat("a/b.txt")
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		if info.Key != "a/b.txt" || info.Size != 5 || time.Since(info.ModTime).Abs() > time.Minute {
+			t.Errorf("Stat: got %+v", info)
+		}
+
+		if _, err := s.Put("a/b.txt", strings.NewReader("hi")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		if got := get(t, s, "a/b.txt"); got != "hi" {
+			t.Errorf("Get after replacing: got %q, want %q", got, "hi")
+		}
+		if got := get(t, s, "/a//b.txt"); got != "hi" {
+			t.Errorf("Get of an unclean key: got %q, want %q", got, "hi")
+		}
+
+		if _, err := s.Put("empty", strings.NewReader("")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		if got := get(t, s, "empty"); got != "" {
+			t.Errorf("Get: got %q, want nothing", got)
+		}
+	})
+
+	t.Run("list and walk", func(t *testing.T) {
+		if _, err := s.Put("a/c/d", strings.NewReader("d")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		if _, err := s.Put("ab", strings.NewReader("ab")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		for prefix, want := range map[string][]string{
+			"":    {"a", "ab", "empty"},
+			"a":   {"b.txt", "c"},
+			"a/c": {"d"},
+		} {
+			names, err := s.List(prefix)
+			sort.Strings(names)
+			if err != nil || !slices.Equal(names, want) {
+				t.Errorf("List(%q): got %v, %v, want %v", prefix, names, err, want)
+			}
+		}
+		if keys, want := walk(t, s, "a"), []string{"a/b.txt", "a/c/d"}; !slices.Equal(keys, want) {
+			t.Errorf("Walk: got %v, want %v", keys, want)
+		}
+		if keys, want := walk(t, s, ""), []string{"a/b.txt", "a/c/d", "ab", "empty"}; !slices.Equal(keys, want) {
+			t.Errorf("Walk: got %v, want %v", keys, want)
+		}
+	})
+
+	t.Run("move", func(t *testing.T) {
+		if err := s.Move("a/b.txt", "f/g"); err != nil {
+			t.Fatalf("Move: %v", err)
+		}
+		if got := get(t, s, "f/g"); got != "hi" {
+			t.Errorf("Get: got %q, want %q", got, "hi")
+		}
+		if _, err := s.Stat("a/b.txt"); !errors.Is(err, ErrNotExist) {
+			t.Errorf("Stat of the source: got %v, want ErrNotExist", err)
+		}
+
+		if err := s.Move("ab", "f/g"); err != nil {
+			t.Fatalf("Move: %v", err)
+		}
+		if got := get(t, s, "f/g"); got != "ab" {
+			t.Errorf("Get after replacing: got %q, want %q", got, "ab")
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := s.Delete("a"); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if _, err := s.Stat("a/c/d"); !errors.Is(err, ErrNotExist) {
+			t.Errorf("Stat below the deleted key: got %v, want ErrNotExist", err)
+		}
+		if err := s.Delete("f/g"); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if keys, want := walk(t, s, ""), []string{"empty"}; !slices.Equal(keys, want) {
+			t.Errorf("Walk: got %v, want %v", keys, want)
+		}
+		if exists, err := Exists(s, "empty"); err != nil || !exists {
+			t.Errorf("Exists: got %v, %v, want true", exists, err)
+		}
+		if exists, err := Exists(s, "f/g"); err != nil || exists {
+			t.Errorf("Exists: got %v, %v, want false", exists, err)
+		}
+	})
+}
+
+func get(t *testing.T, s Storage, key string) string {
+	t.Helper()
+	f, err := s.Get(key)
+	if err != nil {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("reading %q: %v", key, err)
+	}
+	return string(b)
+}
+
+func walk(t *testing.T, s Storage, prefix string) (keys []string) {
+	t.Helper()
+	err := s.Walk(prefix, func(info ObjectInfo) error {
+		keys = append(keys, info.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk(%q): %v", prefix, err)
+	}
+	sort.Strings(keys)
+	return
+}
+
+func TestLocal(t *testing.T) {
+	s, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, s)
+}
+
+func TestMemory(t *testing.T) {
+	testStorage(t, NewMemory())
+}
+
+var (
+	testKeyA = strings.Repeat("aa", 32)
+	testKeyB = strings.Repeat("bb", 32)
+)
+
+func testKeyring(t *testing.T, keys string) *Keyring {
+	t.Helper()
+	k, err := ParseKeyring(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// testData returns n bytes that differ from chunk to chunk, so that data
+// read from the wrong chunk is noticed.
+func testData(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i*7 + i/encChunkSize)
+	}
+	return b
+}
+
+func TestEncryptedFormat(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		size   int
+		chunks int
+	}{
+		{"empty", 0, 1},
+		{"one byte", 1, 1},
+		{"one chunk", encChunkSize, 1},
+		{"one byte more", encChunkSize + 1, 2},
+		{"many chunks", 3*encChunkSize + 100, 4},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := NewMemory()
+			e := NewEncrypted(raw, testKeyring(t, testKeyA))
+			data := testData(tt.size)
+			n, err := e.Put("key", bytes.NewReader(data))
+			want := int64(encHeaderSize + tt.size + tt.chunks*chacha20poly1305.Overhead)
+			if err != nil || n != want {
+				t.Fatalf("Put: got %d, %v, want %d bytes", n, err, want)
+			}
+			stored := []byte(get(t, raw, "key"))
+			if int64(len(stored)) != want || !bytes.HasPrefix(stored, []byte(encMagic)) {
+				t.Errorf("stored %d bytes starting with %q, want %d starting with the magic", len(stored), stored[:len(encMagic)], want)
+			}
+			if tt.size >= 64 && bytes.Contains(stored, data[:64]) {
+				t.Error("the data is stored in the clear")
+			}
+			if got := get(t, e, "key"); got != string(data) {
+				t.Errorf("Get: got %d bytes, want the %d stored", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestEncryptedSeek(t *testing.T) {
+	e := NewEncrypted(NewMemory(), testKeyring(t, testKeyA))
+	data := testData(3*encChunkSize + 100)
+	if _, err := e.Put("key", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	f, err := e.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	s, ok := f.(io.ReadSeeker)
+	if !ok {
+		t.Fatal("Get: the reader of an object in memory can not seek")
+	}
+
+	size := int64(len(data))
+	for _, tt := range []struct {
+		name   string
+		offset int64
+		whence int
+		want   int64
+	}{
+		{"start", 0, io.SeekStart, 0},
+		{"inside the first chunk", 100, io.SeekStart, 100},
+		{"end of a chunk", encChunkSize - 5, io.SeekStart, encChunkSize - 5},
+		{"start of a chunk", 2 * encChunkSize, io.SeekStart, 2 * encChunkSize},
+		{"back to the first chunk", -2*encChunkSize - 19, io.SeekCurrent, 1},
+		{"from the end", -50, io.SeekEnd, size - 50},
+		{"end", 0, io.SeekEnd, size},
+		{"past the end", 10, io.SeekEnd, size + 10},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			pos, err := s.Seek(tt.offset, tt.whence)
+			if err != nil || pos != tt.want {
+				t.Fatalf("Seek: got %d, %v, want %d", pos, err, tt.want)
+			}
+			// the reads cross into the next chunk
+			got, err := io.ReadAll(io.LimitReader(s, 20))
+			if err != nil {
+				t.Fatalf("reading: %v", err)
+			}
+			want := data[min(pos, size):min(pos+20, size)]
+			if !bytes.Equal(got, want) {
+				t.Errorf("read %x, want %x", got, want)
+			}
+		})
+	}
+
+	if _, err := s.Seek(-1, io.SeekStart); err == nil {
+		t.Error("Seek: no error for a negative position")
+	}
+}
+
+func TestEncryptedTamper(t *testing.T) {
+	const chunks = 3
+	header, sealed := encHeaderSize, encSealedSize
+	for _, tt := range []struct {
+		name   string
+		tamper func([]byte) []byte
+	}{
+		{"wrapped key", func(b []byte) []byte { b[header-1] ^= 1; return b }},
+		{"key ID", func(b []byte) []byte { b[len(encMagic)] ^= 1; return b }},
+		{"first chunk", func(b []byte) []byte { b[header+10] ^= 1; return b }},
+		{"final chunk", func(b []byte) []byte { b[len(b)-1] ^= 1; return b }},
+		{"final chunk dropped", func(b []byte) []byte { return b[:header+(chunks-1)*sealed] }},
+		{"cut inside a chunk", func(b []byte) []byte { return b[:header+sealed+100] }},
+		{"data appended", func(b []byte) []byte { return append(b, 0) }},
+		{"chunks reordered", func(b []byte) []byte {
+			first := bytes.Clone(b[header : header+sealed])
+			copy(b[header:], b[header+sealed:header+2*sealed])
+			copy(b[header+sealed:], first)
+			return b
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := NewMemory()
+			e := NewEncrypted(raw, testKeyring(t, testKeyA))
+			if _, err := e.Put("key", bytes.NewReader(testData((chunks-1)*encChunkSize+100))); err != nil {
+				t.Fatal(err)
+			}
+			stored := tt.tamper([]byte(get(t, raw, "key")))
+			if _, err := raw.Put("key", bytes.NewReader(stored)); err != nil {
+				t.Fatal(err)
+			}
+			f, err := e.Get("key")
+			if err == nil {
+				_, err = io.ReadAll(f)
+				f.Close()
+			}
+			if !errors.Is(err, ErrDecrypt) {
+				t.Errorf("got %v, want ErrDecrypt", err)
+			}
+		})
+	}
+}
+
+func TestEncryptedUnencrypted(t *testing.T) {
+	raw := NewMemory()
+	if _, err := raw.Put("old", strings.NewReader("stored in the clear")); err != nil {
+		t.Fatal(err)
+	}
+	e := NewEncrypted(raw, testKeyring(t, testKeyA))
+	if _, err := e.Get("old"); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("Get: got %v, want ErrNotEncrypted", err)
+	}
+	e.ReadUnencrypted = true
+	if got := get(t, e, "old"); got != "stored in the clear" {
+		t.Errorf("Get with ReadUnencrypted: got %q", got)
+	}
+}
+
+func TestEncryptedRotateKeys(t *testing.T) {
+	raw := NewMemory()
+	if _, err := raw.Put("plain", strings.NewReader("stored in the clear")); err != nil {
+		t.Fatal(err)
+	}
+	old := NewEncrypted(raw, testKeyring(t, testKeyA))
+	data := testData(2*encChunkSize + 1)
+	if _, err := old.Put("a", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	e := NewEncrypted(raw, testKeyring(t, testKeyB+","+testKeyA))
+	if got := get(t, e, "a"); got != string(data) {
+		t.Error("Get: an object of the older key can not be read")
+	}
+	n, err := e.RotateKeys()
+	if err != nil || n != 2 {
+		t.Fatalf("RotateKeys: got %d, %v, want 2 objects rewritten", n, err)
+	}
+	if n, err := e.RotateKeys(); err != nil || n != 0 {
+		t.Errorf("RotateKeys again: got %d, %v, want nothing rewritten", n, err)
+	}
+
+	// the older key is not needed anymore
+	if _, err := old.Get("a"); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("Get with the older key: got %v, want ErrDecrypt", err)
+	}
+	current := NewEncrypted(raw, testKeyring(t, testKeyB))
+	if got := get(t, current, "a"); got != string(data) {
+		t.Error("Get: the rotated object can not be read with the new key")
+	}
+	if got := get(t, current, "plain"); got != "stored in the clear" {
+		t.Errorf("Get: got %q for the object stored in the clear", got)
+	}
+}